@@ -1,77 +1,366 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
-	"sync" // Потрібен для синхронізації доступу до map
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+var (
+	port      = flag.Int("port", 8081, "db server port")
+	engine    = flag.String("engine", "log", "storage backend: log, lsm or memory")
+	dir       = flag.String("dir", "data", "directory for the datastore files")
+	cacheSize = flag.Int64("cache-size", 1<<20, "bytes of values cached in memory by the log backend")
+	keyFile   = flag.String("key-file", "", "file with encryption keys (id:hex-key per line, current first)")
+	queueSize = flag.Int("queue-size", 100, "writes that may wait for the log backend before writes return 503")
+	indexes   indexFlags
 )
 
-type KeyValueStore interface {
-	Get(key string) (string, error)
-	Put(key string, value string) error
+func init() {
+	flag.Var(&indexes, "index", "secondary index on JSON values as name=[bucket:]path, may be repeated")
 }
 
-type InMemoryDb struct {
-	mu   sync.RWMutex 
-	data map[string]string
+// indexFlags collects -index declarations.
+type indexFlags []datastore.IndexSpec
+
+func (f *indexFlags) String() string {
+	return fmt.Sprint(*f)
 }
 
-func NewInMemoryDb() *InMemoryDb {
-	return &InMemoryDb{
-		data: make(map[string]string),
+func (f *indexFlags) Set(value string) error {
+	name, target, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("index %q must look like name=[bucket:]path", value)
+	}
+	spec := datastore.IndexSpec{Name: name, Path: target}
+	if bucket, path, ok := strings.Cut(target, ":"); ok {
+		spec.Bucket, spec.Path = bucket, path
 	}
+	*f = append(*f, spec)
+	return nil
 }
 
-func (imdb *InMemoryDb) Get(key string) (string, error) {
-	imdb.mu.RLock()
-	defer imdb.mu.RUnlock()
-	value, ok := imdb.data[key]
-	if !ok {
-		return "", fmt.Errorf("key '%s' not found", key)
+var db datastore.Store
+
+func openStore() (datastore.Store, error) {
+	keyring, err := datastore.LoadKeyring(*keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load encryption keys: %w", err)
+	}
+	if keyring != nil && *engine != "log" {
+		return nil, fmt.Errorf("encryption is not supported by the %s engine", *engine)
+	}
+	if len(indexes) > 0 && *engine != "log" {
+		return nil, fmt.Errorf("secondary indexes are not supported by the %s engine", *engine)
+	}
+
+	if *engine == "memory" {
+		return datastore.NewMemoryStore(), nil
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return nil, err
+	}
+	switch *engine {
+	case "log":
+		return datastore.OpenWithOptions(*dir, datastore.Options{
+			CacheSize: *cacheSize,
+			Keyring:   keyring,
+			Indexes:   indexes,
+			QueueSize: *queueSize,
+		})
+	case "lsm":
+		return datastore.OpenLSM(*dir)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", *engine)
 	}
-	return value, nil
 }
 
+func main() {
+	flag.Parse()
 
-func (imdb *InMemoryDb) Put(key string, value string) error {
-	imdb.mu.Lock() 
-	defer imdb.mu.Unlock()
-	imdb.data[key] = value
-	return nil
+	var err error
+	db, err = openStore()
+	if err != nil {
+		log.Fatalf("Cannot open the datastore: %s", err)
+	}
+	log.Printf("Initialized %s DB successfully.", *engine)
+
+	h := new(http.ServeMux)
+	h.HandleFunc("/db/", handleDbRequest)
+	h.HandleFunc("/metrics", handleMetrics)
+
+	server := httptools.CreateServer(*port, h)
+	server.Start()
+	signal.WaitForTerminationSignal()
+
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close the datastore: %s", err)
+	}
 }
 
-var db KeyValueStore 
+// kvStore is the part of datastore.Store offered by bucket handles too.
+type kvStore interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+}
 
-func main() {
+// tryPutter, tryDeleter, tryStreamer and tryBucketDeleter are implemented by stores that can
+// refuse a write instead of waiting for a full write queue.
+type tryPutter interface {
+	TryPutContext(ctx context.Context, key, value string) error
+}
+
+type tryDeleter interface {
+	TryDeleteContext(ctx context.Context, key string) error
+}
 
-	db = NewInMemoryDb()
-	log.Println("Initialized in-memory DB successfully.")
+type tryStreamer interface {
+	TryPutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+type tryBucketDeleter interface {
+	TryDeleteBucket(ctx context.Context, name string) error
+}
+
+// retryAfter is the Retry-After value, in seconds, sent with writes refused
+// because of a full queue.
+const retryAfter = "1"
+
+// streamStore is implemented by stores that read and write values without
+// holding them in memory.
+type streamStore interface {
+	PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error
+	GetStream(key string) (io.ReadCloser, error)
+}
+
+// rawContentType marks request and response bodies holding a bare value.
+const rawContentType = "application/octet-stream"
+
+// bucketStore is implemented by backends with named buckets.
+type bucketStore interface {
+	Bucket(name string) *datastore.Bucket
+	Buckets() []string
+	DeleteBucket(ctx context.Context, name string) error
+}
 
-	http.HandleFunc("/db/", handleDbRequest)
-	fmt.Println("DB server (in-memory) running on :8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+// indexStore is implemented by backends with secondary indexes.
+type indexStore interface {
+	bucketStore
+	Index(name string) (datastore.IndexSpec, bool)
+	Lookup(name, eq string) ([]string, error)
 }
 
+// exportStore is implemented by backends that dump and load all of their
+// keys as JSON Lines.
+type exportStore interface {
+	ExportContext(ctx context.Context, w io.Writer) error
+	ImportContext(ctx context.Context, r io.Reader) (int, error)
+}
+
+// handleDbRequest serves /db/{key} for the default bucket, /db/{bucket}/{key}
+// for named ones, /db/{bucket}/ for whole buckets and /db/ for the list of
+// buckets. /db/_index/{name} queries secondary indexes, /db/_export and
+// /db/_import dump and load the whole store. Names starting with _ are kept
+// for such routes, so keys and buckets with them cannot be written.
 func handleDbRequest(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/db/")
-	if key == "" {
+	// Keys are path-escaped by clients, so an escaped slash belongs to the key.
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			http.Error(w, "bad path", http.StatusBadRequest)
+			return
+		}
+		parts[i] = unescaped
+	}
+
+	switch {
+	case len(parts) == 2 && parts[0] == "_index":
+		handleIndex(w, r, parts[1])
+	case len(parts) == 1 && (parts[0] == "_export" || parts[0] == "_import"):
+		handleExport(w, r, parts[0])
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && reservedName(parts):
+		http.Error(w, "keys and buckets starting with _ are reserved", http.StatusBadRequest)
+	case len(parts) == 1 && parts[0] != "":
+		handleKey(w, r, db, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		withBuckets(w, func(bs bucketStore) {
+			writeJSON(w, map[string]interface{}{"buckets": bs.Buckets()})
+		})
+	case len(parts) == 1:
 		http.Error(w, "missing key", http.StatusBadRequest)
+	case len(parts) == 2 && parts[0] != "":
+		withBuckets(w, func(bs bucketStore) {
+			if parts[1] == "" {
+				handleBucket(w, r, bs, parts[0])
+			} else {
+				handleKey(w, r, bs.Bucket(parts[0]), parts[1])
+			}
+		})
+	default:
+		http.Error(w, "bad path", http.StatusBadRequest)
+	}
+}
+
+// reservedName tells whether any of the names starts with _.
+func reservedName(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+func withBuckets(w http.ResponseWriter, fn func(bs bucketStore)) {
+	bs, ok := db.(bucketStore)
+	if !ok {
+		http.Error(w, "buckets are not supported by the storage engine", http.StatusNotImplemented)
 		return
 	}
+	fn(bs)
+}
+
+func handleBucket(w http.ResponseWriter, r *http.Request, bs bucketStore, name string) {
 	switch r.Method {
 	case http.MethodGet:
-		val, err := db.Get(key)
+		keys, err := bs.Bucket(name).Keys()
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"bucket": name, "keys": keys})
+	case http.MethodDelete:
+		del := bs.DeleteBucket
+		if td, ok := bs.(tryBucketDeleter); ok {
+			del = td.TryDeleteBucket
+		}
+		if err := del(r.Context(), name); err != nil {
+			if refusedBusy(w, err) {
+				return
+			}
+			http.Error(w, "failed to delete bucket", errorStatus(err))
+			log.Printf("Failed to delete bucket '%s': %v", name, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportContentType is the media type of JSON Lines.
+const exportContentType = "application/x-ndjson"
+
+func handleExport(w http.ResponseWriter, r *http.Request, op string) {
+	es, ok := db.(exportStore)
+	if !ok {
+		http.Error(w, "export is not supported by the storage engine", http.StatusNotImplemented)
+		return
+	}
+	switch {
+	case op == "_export" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", exportContentType)
+		if err := es.ExportContext(r.Context(), w); err != nil {
+			// Records are streamed, so the status is sent already.
+			log.Printf("Export failed: %v", err)
+		}
+	case op == "_import" && r.Method == http.MethodPost:
+		n, err := es.ImportContext(r.Context(), r.Body)
+		if err != nil {
+			if refusedBusy(w, err) {
+				return
+			}
+			status := errorStatus(err)
+			if errors.Is(err, datastore.ErrBadRecord) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("import failed after %d records: %s", n, err), status)
+			log.Printf("Import failed after %d records: %v", n, err)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"imported": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	is, ok := db.(indexStore)
+	if !ok {
+		http.Error(w, "indexes are not supported by the storage engine", http.StatusNotImplemented)
+		return
+	}
+	spec, ok := is.Index(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	eq := r.URL.Query().Get("eq")
+	keys, err := is.Lookup(name, eq)
+	if err != nil {
+		http.Error(w, "failed to query index", errorStatus(err))
+		log.Printf("Failed to query index '%s': %v", name, err)
+		return
+	}
+
+	var store kvStore = db
+	if spec.Bucket != "" {
+		store = is.Bucket(spec.Bucket)
+	}
+	records := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		value, err := store.GetContext(r.Context(), key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, "failed to read value", errorStatus(err))
+			log.Printf("Failed to get key '%s': %v", key, err)
+			return
+		}
+		records = append(records, map[string]string{"key": key, "value": value})
+	}
+	writeJSON(w, map[string]interface{}{"index": name, "eq": eq, "records": records})
+}
+
+func handleKey(w http.ResponseWriter, r *http.Request, store kvStore, key string) {
+	ss, streams := store.(streamStore)
+	switch r.Method {
+	case http.MethodGet:
+		if streams && strings.Contains(r.Header.Get("Accept"), rawContentType) {
+			getRaw(w, r, ss, key)
+			return
+		}
+		val, err := store.GetContext(r.Context(), key)
+		if errors.Is(err, datastore.ErrNotFound) {
 			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to read value", errorStatus(err))
 			log.Printf("Failed to get key '%s': %v", key, err)
 			return
 		}
-		resp := map[string]interface{}{"key": key, "value": val}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+		writeJSON(w, map[string]interface{}{"key": key, "value": val})
 	case http.MethodPost:
 		var body map[string]interface{}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -88,13 +377,118 @@ func handleDbRequest(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "value must be a string", http.StatusBadRequest)
 			return
 		}
-		if err := db.Put(key, strVal); err != nil {
-			http.Error(w, "failed to write value", http.StatusInternalServerError)
-			log.Printf("Failed to put key '%s': %v", key, err) 
+		put := store.PutContext
+		if tp, ok := store.(tryPutter); ok {
+			put = tp.TryPutContext
+		}
+		if err := put(r.Context(), key, strVal); err != nil {
+			if refusedBusy(w, err) {
+				return
+			}
+			http.Error(w, "failed to write value", errorStatus(err))
+			log.Printf("Failed to put key '%s': %v", key, err)
 			return
 		}
 		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		if !streams {
+			http.Error(w, "raw values are not supported by the storage engine", http.StatusNotImplemented)
+			return
+		}
+		putRaw(w, r, ss, key)
+	case http.MethodDelete:
+		del := store.DeleteContext
+		if td, ok := store.(tryDeleter); ok {
+			del = td.TryDeleteContext
+		}
+		if err := del(r.Context(), key); err != nil {
+			if refusedBusy(w, err) {
+				return
+			}
+			http.Error(w, "failed to delete value", errorStatus(err))
+			log.Printf("Failed to delete key '%s': %v", key, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
-}
\ No newline at end of file
+}
+
+// putRaw streams a request body holding a bare value to the store.
+func putRaw(w http.ResponseWriter, r *http.Request, ss streamStore, key string) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != rawContentType {
+		http.Error(w, "PUT expects an "+rawContentType+" body", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	put := ss.PutStreamContext
+	if ts, ok := ss.(tryStreamer); ok {
+		put = ts.TryPutStreamContext
+	}
+	err := put(r.Context(), key, r.Body, r.ContentLength)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		http.Error(w, "body is shorter than Content-Length", http.StatusBadRequest)
+		return
+	}
+	if refusedBusy(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to write value", errorStatus(err))
+		log.Printf("Failed to put key '%s': %v", key, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getRaw streams a value to the response as it is.
+func getRaw(w http.ResponseWriter, r *http.Request, ss streamStore, key string) {
+	value, err := ss.GetStream(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to read value", errorStatus(err))
+		log.Printf("Failed to get key '%s': %v", key, err)
+		return
+	}
+	defer value.Close()
+	w.Header().Set("Content-Type", rawContentType)
+	if _, err := io.Copy(w, value); err != nil {
+		// The status is sent already; the client sees a cut response.
+		log.Printf("Failed to stream key '%s': %v", key, err)
+	}
+}
+
+// refusedBusy answers a write refused because of a full queue with 503 and
+// Retry-After, and tells whether err was such a refusal.
+func refusedBusy(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, datastore.ErrBusy) {
+		return false
+	}
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, "write queue is full", http.StatusServiceUnavailable)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// errorStatus maps datastore errors to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrClosed),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func useStore(t *testing.T, store datastore.Store) {
+	t.Helper()
+	prev := db
+	db = store
+	t.Cleanup(func() {
+		_ = store.Close()
+		db = prev
+	})
+}
+
+func doRequest(method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleDbRequest(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// rawRequest returns a PUT of a bare value.
+func rawRequest(target, value string) *http.Request {
+	req := httptest.NewRequest("PUT", target, strings.NewReader(value))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req
+}
+
+func TestHandleDbRequest_Buckets(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+
+	for _, target := range []string{"/db/key", "/db/team/key", "/db/team/a%2Fb"} {
+		if rec := doRequest("POST", target, `{"value": "`+target+`"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("POST %s: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	for _, target := range []string{"/db/key", "/db/team/key", "/db/team/a%2Fb"} {
+		rec := doRequest("GET", target, "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"value":"`+target+`"`) {
+			t.Errorf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := doRequest("GET", "/db/team/", ""); !strings.Contains(rec.Body.String(), `"keys":["a/b","key"]`) {
+		t.Errorf("Bucket listing: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest("GET", "/db/", ""); !strings.Contains(rec.Body.String(), `"buckets":["team"]`) {
+		t.Errorf("Buckets listing: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := doRequest("DELETE", "/db/team/", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE bucket: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest("GET", "/db/team/key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET from a deleted bucket: %d", rec.Code)
+	}
+	if rec := doRequest("GET", "/db/key", ""); rec.Code != http.StatusOK {
+		t.Errorf("Deleting a bucket touched the default one: %d", rec.Code)
+	}
+}
+
+func TestHandleDbRequest_NoBuckets(t *testing.T) {
+	useStore(t, datastore.NewMemoryStore())
+
+	if rec := doRequest("GET", "/db/team/key", ""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Bucket request to the memory engine: %d", rec.Code)
+	}
+	if rec := doRequest("POST", "/db/key", `{"value": "v"}`); rec.Code != http.StatusCreated {
+		t.Errorf("POST to the memory engine: %d", rec.Code)
+	}
+}
+
+func TestHandleDbRequest_Index(t *testing.T) {
+	store, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{
+		Indexes: []datastore.IndexSpec{{Name: "byTeam", Path: "team"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+
+	doRequest("POST", "/db/p1", `{"value": "{\"team\": \"pickmeshki\"}"}`)
+	doRequest("POST", "/db/p2", `{"value": "{\"team\": \"other\"}"}`)
+
+	rec := doRequest("GET", "/db/_index/byTeam?eq=pickmeshki", "")
+	expected := `"records":[{"key":"p1","value":"{\"team\": \"pickmeshki\"}"}]`
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("Index query: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest("GET", "/db/_index/missing?eq=x", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Query of a missing index: %d", rec.Code)
+	}
+}
+
+// busyStore refuses every write as if its queue were full.
+type busyStore struct {
+	*datastore.MemoryStore
+}
+
+func (busyStore) TryPutContext(context.Context, string, string) error {
+	return datastore.ErrBusy
+}
+
+func (busyStore) TryDeleteContext(context.Context, string) error {
+	return datastore.ErrBusy
+}
+
+func (busyStore) PutStreamContext(context.Context, string, io.Reader, int64) error {
+	return nil
+}
+
+func (busyStore) GetStream(string) (io.ReadCloser, error) {
+	return nil, datastore.ErrNotFound
+}
+
+func (busyStore) TryPutStreamContext(context.Context, string, io.Reader, int64) error {
+	return datastore.ErrBusy
+}
+
+func TestHandleDbRequest_Busy(t *testing.T) {
+	useStore(t, busyStore{datastore.NewMemoryStore()})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/db/key", strings.NewReader(`{"value": "v"}`)),
+		httptest.NewRequest("DELETE", "/db/key", nil),
+		rawRequest("/db/key", "v"),
+	} {
+		rec := httptest.NewRecorder()
+		handleDbRequest(rec, req)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s to a busy store: %d, Retry-After %q", req.Method, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// busyBuckets refuses bucket deletions as if the write queue were full.
+type busyBuckets struct {
+	*datastore.Db
+}
+
+func (busyBuckets) TryDeleteBucket(context.Context, string) error {
+	return datastore.ErrBusy
+}
+
+func TestHandleDbRequest_BusyBucketDelete(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, busyBuckets{store})
+	store.Bucket("team").Put("key", "v")
+
+	rec := doRequest("DELETE", "/db/team/", "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("DELETE of a bucket in a busy store: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandleDbRequest_Raw(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+
+	value := strings.Repeat("raw bytes ", 1000)
+	req := httptest.NewRequest("PUT", "/db/team/blob", strings.NewReader(value))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rec := httptest.NewRecorder()
+	handleDbRequest(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Raw PUT: %d %s", rec.Code, rec.Body)
+	}
+
+	req = httptest.NewRequest("GET", "/db/team/blob", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	rec = httptest.NewRecorder()
+	handleDbRequest(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != value {
+		t.Errorf("Raw GET: %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	if rec := doRequest("PUT", "/db/blob", value); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT without a content type: %d", rec.Code)
+	}
+	req = rawRequest("/db/blob", value)
+	req.Header.Set("Content-Type", "application/octet-stream; charset=binary")
+	rec = httptest.NewRecorder()
+	handleDbRequest(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("PUT with content type parameters: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleDbRequest_ExportImport(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+
+	body := `{"key":"a","value":"1"}` + "\n" + `{"bucket":"team","key":"b","value":"2"}` + "\n"
+	if rec := doRequest("POST", "/db/_import", body); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"imported":2`) {
+		t.Fatalf("Import: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest("GET", "/db/team/b", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET of an imported key: %d", rec.Code)
+	}
+
+	rec := doRequest("GET", "/db/_export", "")
+	expected := `{"bucket":"team","key":"b","value":"2"}` + "\n" + `{"key":"a","value":"1"}` + "\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Export: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := doRequest("POST", "/db/_import", `{"key":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Import of malformed records: %d", rec.Code)
+	}
+}
+
+func TestHandleDbRequest_ImportClosed(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := doRequest("POST", "/db/_import", `{"key":"a","value":"1"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Import into a closed store: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleDbRequest_ReservedNames(t *testing.T) {
+	store, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, store)
+
+	for _, target := range []string{"/db/_index", "/db/_mine", "/db/_team/key", "/db/team/_key"} {
+		if rec := doRequest("POST", target, `{"value": "v"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: %d", target, rec.Code)
+		}
+		req := rawRequest(target, "v")
+		rec := httptest.NewRecorder()
+		handleDbRequest(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d", target, rec.Code)
+		}
+	}
+
+	// The admin routes stay reachable.
+	if rec := doRequest("POST", "/db/_import", `{"key":"a","value":"1"}`); rec.Code != http.StatusOK {
+		t.Errorf("Import: %d %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest("GET", "/db/_export", ""); rec.Code != http.StatusOK {
+		t.Errorf("Export: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleMetrics serves datastore stats in the Prometheus text exposition
+// format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := db.Stats()
+	if err != nil {
+		http.Error(w, "failed to collect stats", http.StatusInternalServerError)
+		log.Printf("Failed to collect stats: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, stats)
+}
+
+func writeMetrics(w io.Writer, stats datastore.Stats) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("datastore_keys", "gauge", "Number of live keys.")
+	fmt.Fprintf(w, "datastore_keys %d\n", stats.Keys)
+	metric("datastore_bytes", "gauge", "Bytes occupied by the data files.")
+	fmt.Fprintf(w, "datastore_bytes %d\n", stats.Bytes)
+	metric("datastore_segments", "gauge", "Number of closed segments.")
+	fmt.Fprintf(w, "datastore_segments %d\n", stats.Segments)
+
+	if len(stats.Files) > 0 {
+		metric("datastore_file_bytes", "gauge", "Bytes of every data file, total and still live.")
+		for _, file := range stats.Files {
+			fmt.Fprintf(w, "datastore_file_bytes{file=%q,kind=\"total\"} %d\n", file.Name, file.TotalBytes)
+			fmt.Fprintf(w, "datastore_file_bytes{file=%q,kind=\"live\"} %d\n", file.Name, file.LiveBytes)
+		}
+	}
+
+	metric("datastore_write_queue_depth", "gauge", "Writes waiting to be applied.")
+	fmt.Fprintf(w, "datastore_write_queue_depth %d\n", stats.QueueDepth)
+	metric("datastore_write_queue_capacity", "gauge", "Writes the queue can hold.")
+	fmt.Fprintf(w, "datastore_write_queue_capacity %d\n", stats.QueueCapacity)
+	metric("datastore_write_rejected_total", "counter", "Writes refused because the queue was full.")
+	fmt.Fprintf(w, "datastore_write_rejected_total %d\n", stats.Rejected)
+	writeHistogram(w, "datastore_write_queue_wait_seconds", "Time writes spent in the queue.", stats.QueueWait)
+
+	metric("datastore_merges_total", "counter", "Completed segment merges.")
+	fmt.Fprintf(w, "datastore_merges_total %d\n", stats.Merges)
+	metric("datastore_merge_seconds_total", "counter", "Time spent merging segments.")
+	fmt.Fprintf(w, "datastore_merge_seconds_total %g\n", stats.MergeDuration.Seconds())
+	metric("datastore_checksum_failures_total", "counter", "Records that failed checksum verification.")
+	fmt.Fprintf(w, "datastore_checksum_failures_total %d\n", stats.ChecksumFailures)
+	metric("datastore_index_failures_total", "counter", "Stored records the secondary indexes could not take.")
+	fmt.Fprintf(w, "datastore_index_failures_total %d\n", stats.IndexFailures)
+
+	writeHistogram(w, "datastore_get_duration_seconds", "Duration of Get calls.", stats.GetLatency)
+	writeHistogram(w, "datastore_put_duration_seconds", "Duration of Put and Delete calls.", stats.PutLatency)
+
+	metric("datastore_cache_hits_total", "counter", "Value cache hits.")
+	fmt.Fprintf(w, "datastore_cache_hits_total %d\n", stats.Cache.Hits)
+	metric("datastore_cache_misses_total", "counter", "Value cache misses.")
+	fmt.Fprintf(w, "datastore_cache_misses_total %d\n", stats.Cache.Misses)
+	metric("datastore_cache_bytes", "gauge", "Bytes held by the value cache.")
+	fmt.Fprintf(w, "datastore_cache_bytes %d\n", stats.Cache.Bytes)
+}
+
+func writeHistogram(w io.Writer, name, help string, latency datastore.LatencyStats) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range datastore.LatencyBuckets {
+		var count uint64
+		if i < len(latency.Buckets) {
+			count = latency.Buckets[i]
+		}
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, latency.Count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, latency.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, latency.Count)
+}
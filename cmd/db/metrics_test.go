@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	buckets := make([]uint64, len(datastore.LatencyBuckets))
+	buckets[len(buckets)-1] = 2
+	stats := datastore.Stats{
+		Keys:  3,
+		Files: []datastore.SegmentStats{{Name: "current-data", LiveBytes: 10, TotalBytes: 20}},
+		GetLatency: datastore.LatencyStats{
+			Count:   3,
+			Sum:     1500 * time.Millisecond,
+			Buckets: buckets,
+		},
+	}
+
+	var out bytes.Buffer
+	writeMetrics(&out, stats)
+	text := out.String()
+
+	for _, line := range []string{
+		"datastore_keys 3",
+		`datastore_file_bytes{file="current-data",kind="live"} 10`,
+		`datastore_get_duration_seconds_bucket{le="1"} 2`,
+		`datastore_get_duration_seconds_bucket{le="+Inf"} 3`,
+		"datastore_get_duration_seconds_sum 1.5",
+		"# TYPE datastore_put_duration_seconds histogram",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics output misses %q:\n%s", line, text)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Command dbtool works with the files of a log datastore directly.
+//
+//	dbtool export [-dir data] [-o file]   writes all keys as JSON Lines
+//	dbtool import [-dir data] [-i file]   stores keys from JSON Lines
+//
+// Export opens the directory read-only and may run next to a db server;
+// import needs the server to be stopped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbtool export|import [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dir := fs.String("dir", "data", "directory of the datastore")
+	keyFile := fs.String("key-file", "", "file with encryption keys (id:hex-key per line, current first)")
+
+	switch os.Args[1] {
+	case "export":
+		output := fs.String("o", "", "output file; standard output by default")
+		fs.Parse(os.Args[2:])
+		if err := export(*dir, *keyFile, *output); err != nil {
+			log.Fatalf("Export failed: %s", err)
+		}
+	case "import":
+		input := fs.String("i", "", "input file; standard input by default")
+		fs.Parse(os.Args[2:])
+		n, err := importFile(*dir, *keyFile, *input)
+		if err != nil {
+			log.Fatalf("Import failed after %d records: %s", n, err)
+		}
+		log.Printf("Imported %d records.", n)
+	default:
+		usage()
+	}
+}
+
+func export(dir, keyFile, output string) error {
+	keyring, err := datastore.LoadKeyring(keyFile)
+	if err != nil {
+		return err
+	}
+	db, err := datastore.OpenWithOptions(dir, datastore.Options{ReadOnly: true, Keyring: keyring})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := db.Export(out); err != nil {
+		return err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+func importFile(dir, keyFile, input string) (int, error) {
+	keyring, err := datastore.LoadKeyring(keyFile)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, err
+	}
+	db, err := datastore.OpenWithOptions(dir, datastore.Options{Keyring: keyring})
+	if err != nil {
+		return 0, err
+	}
+
+	var in io.Reader = os.Stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			db.Close()
+			return 0, err
+		}
+		defer f.Close()
+		in = f
+	}
+	n, err := db.Import(in)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Kinds of affinity keys accepted by -affinity.
+const (
+	affinityIP        = "ip"
+	affinityForwarded = "forwarded-for"
+	affinityHeader    = "header"
+	affinityCookie    = "cookie"
+	affinityQuery     = "query"
+)
+
+const (
+	defaultAffinityCookie = "lb-affinity"
+	defaultAffinityQuery  = "key"
+)
+
+// affinity tells what the client-hash strategy hashes to keep a client on
+// one backend. The zero value uses the client IP.
+type affinity struct {
+	kind string
+	// name is the header, cookie or query parameter holding the key.
+	name string
+}
+
+// parseAffinity parses the -affinity flag: ip, forwarded-for,
+// header:<name>, cookie[:<name>] or query[:<name>].
+func parseAffinity(spec string) (affinity, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	a := affinity{kind: kind, name: name}
+	switch kind {
+	case affinityIP, affinityForwarded:
+		if name != "" {
+			return affinity{}, fmt.Errorf("affinity %s takes no name", kind)
+		}
+	case affinityHeader:
+		if name == "" {
+			return affinity{}, fmt.Errorf("affinity header needs a header name")
+		}
+		a.name = http.CanonicalHeaderKey(name)
+	case affinityCookie:
+		if a.name == "" {
+			a.name = defaultAffinityCookie
+		}
+	case affinityQuery:
+		if a.name == "" {
+			a.name = defaultAffinityQuery
+		}
+	default:
+		return affinity{}, fmt.Errorf("unknown affinity %q", spec)
+	}
+	return a, nil
+}
+
+// key returns the affinity key of r. Requests without one fall back to the
+// client IP.
+func (a affinity) key(r *http.Request) string {
+	var key string
+	switch a.kind {
+	case affinityForwarded:
+		// The first address is the client as seen by the first proxy. It is
+		// only trustworthy when the balancer sits behind such a proxy.
+		first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+		key = strings.TrimSpace(first)
+	case affinityHeader:
+		key = r.Header.Get(a.name)
+	case affinityCookie:
+		if c, err := r.Cookie(a.name); err == nil {
+			key = c.Value
+		}
+	case affinityQuery:
+		key = r.URL.Query().Get(a.name)
+	}
+	if key == "" {
+		key = clientIP(r)
+	}
+	return key
+}
+
+// stick gives a client without the affinity cookie a new one and returns
+// the request carrying it, so that the first request already lands where
+// the following ones will. Other kinds of affinity leave r as it is.
+func (a affinity) stick(rw http.ResponseWriter, r *http.Request) *http.Request {
+	if a.kind != affinityCookie {
+		return r
+	}
+	if c, err := r.Cookie(a.name); err == nil && c.Value != "" {
+		return r
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return r
+	}
+	c := &http.Cookie{
+		Name:     a.name,
+		Value:    hex.EncodeToString(id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(rw, c)
+	r = r.Clone(r.Context())
+	r.AddCookie(c)
+	return r
+}
+
+// clientIP returns the address of the client without the port, which
+// changes with every connection.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
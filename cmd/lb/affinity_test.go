@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAffinity(t *testing.T) {
+	for spec, expected := range map[string]affinity{
+		"ip":               {kind: affinityIP},
+		"forwarded-for":    {kind: affinityForwarded},
+		"header:x-user-id": {kind: affinityHeader, name: "X-User-Id"},
+		"cookie":           {kind: affinityCookie, name: defaultAffinityCookie},
+		"cookie:session":   {kind: affinityCookie, name: "session"},
+		"query":            {kind: affinityQuery, name: "key"},
+		"query:user":       {kind: affinityQuery, name: "user"},
+	} {
+		a, err := parseAffinity(spec)
+		if assert.NoError(t, err, spec) {
+			assert.Equal(t, expected, a, spec)
+		}
+	}
+	for _, spec := range []string{"", "port", "header", "ip:x"} {
+		_, err := parseAffinity(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestAffinity_Key(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/v1/some-data?key=team", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "192.168.1.7, 10.0.0.1")
+	req.Header.Set("X-User-Id", "42")
+	req.AddCookie(&http.Cookie{Name: defaultAffinityCookie, Value: "abc"})
+
+	for spec, expected := range map[string]string{
+		"ip":               "10.0.0.1",
+		"forwarded-for":    "192.168.1.7",
+		"header:X-User-Id": "42",
+		"cookie":           "abc",
+		"query":            "team",
+	} {
+		a, _ := parseAffinity(spec)
+		assert.Equal(t, expected, a.key(req), spec)
+	}
+
+	bare := httptest.NewRequest("GET", "/", nil)
+	bare.RemoteAddr = "10.0.0.2:40000"
+	for _, spec := range []string{"forwarded-for", "header:X-User-Id", "cookie", "query"} {
+		a, _ := parseAffinity(spec)
+		assert.Equal(t, "10.0.0.2", a.key(bare), "%s without a key falls back to the IP", spec)
+	}
+}
+
+func TestClientHash_IgnoresClientPort(t *testing.T) {
+	s, _ := newStrategy(strategyClientHash, newLoadStats(), defaultVirtualNodes, affinity{})
+	first := ""
+	for port := 40000; port < 40020; port++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.168.1.100:%d", port)
+		server := s.choose(strategyBackends, req).Addr
+		if first == "" {
+			first = server
+		}
+		assert.Equal(t, first, server, "A new connection moved the client")
+	}
+}
+
+func TestPool_StickyCookie(t *testing.T) {
+	var backends []backend
+	for i := 0; i < 4; i++ {
+		b := newTestBackend(t, fmt.Sprintf("b%d", i))
+		backends = append(backends, backend{Addr: b.addr(), Weight: 1, HealthPath: "/health"})
+	}
+	p := newPool(backends)
+	aff, _ := parseAffinity("cookie")
+	require.NoError(t, p.setStrategy(strategyClientHash, defaultVirtualNodes, aff))
+	p.checkAll()
+	handler := p.handler()
+
+	// Every client comes from the same address, as if behind a proxy.
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		first := serve(nil)
+		cookies := first.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, defaultAffinityCookie, cookies[0].Name)
+
+		backend := first.Header().Get("backend")
+		used[backend] = true
+		for j := 0; j < 3; j++ {
+			next := serve(cookies[0])
+			assert.Equal(t, backend, next.Header().Get("backend"))
+			assert.Empty(t, next.Result().Cookies(), "The cookie was set again")
+		}
+	}
+	assert.Greater(t, len(used), 1, "Cookies did not spread clients behind one address")
+}
+
+func TestPool_AffinityNeedsClientHash(t *testing.T) {
+	p := newPool(nil)
+	aff, _ := parseAffinity("cookie")
+	assert.Error(t, p.setStrategy(strategyRoundRobin, defaultVirtualNodes, aff))
+
+	ip, _ := parseAffinity(affinityIP)
+	require.NoError(t, p.setStrategy(strategyRoundRobin, defaultVirtualNodes, ip))
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Same(t, req, p.affinity.stick(httptest.NewRecorder(), req))
+}
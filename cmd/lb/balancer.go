@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
@@ -18,18 +19,26 @@ import (
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
-	https      = flag.Bool("https", false, "whether backends support HTTPs")
+
+	connectTimeout        = flag.Duration("connect-timeout", time.Second, "how long connecting to a backend may take, 0 for no limit")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 0, "how long a backend may take to start answering, 0 for no limit")
+	routeTimeouts         = flag.String("route-timeouts", "", "comma-separated prefix=duration pairs overriding -timeout-sec for paths starting with prefix")
+	https                 = flag.Bool("https", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
-)
 
-var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
-	}
+	backendList      = flag.String("backends", "server1:8080,server2:8080", "comma-separated backend addresses, each optionally followed by @weight")
+	configPath       = flag.String("config", "", "YAML or JSON file with the backend pool; overrides -backends")
+	reloadInterval   = flag.Duration("reload-interval", 5*time.Second, "how often the -config file is checked for changes")
+	strategyName     = flag.String("strategy", strategyClientHash, "balancing strategy: "+strings.Join(strategyNames, ", "))
+	affinitySpec     = flag.String("affinity", affinityIP, "what the client-hash strategy keeps clients by: ip, forwarded-for, header:<name>, cookie[:<name>] or query[:<name>]")
+	retryLimit       = flag.Int("retries", defaultRetries, "how many other backends a failed request may be retried on")
+	retryRatio       = flag.Float64("retry-budget", defaultRetryBudget, "retries allowed per request on average, to keep retries from piling on failing backends")
+	breakerFailures  = flag.Int("breaker-failures", defaultBreakerConfig.failures, "consecutive failed requests that eject a backend, 0 to disable")
+	breakerErrorRate = flag.Float64("breaker-error-rate", defaultBreakerConfig.errorRate, "share of failed requests in the window that ejects a backend")
+	breakerWindow    = flag.Int("breaker-window", defaultBreakerConfig.window, "number of recent requests the error rate is computed over, 0 to disable")
+	breakerCooldown  = flag.Duration("breaker-cooldown", defaultBreakerConfig.cooldown, "how long a backend stays ejected before a probe request")
+	virtualNodes     = flag.Int("virtual-nodes", defaultVirtualNodes, "points per unit of backend weight on the client-hash ring")
 )
 
 func scheme() string {
@@ -39,79 +48,289 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+// pool keeps the configured backends, the outcome of the last health
+// check of each and their circuit breakers. It is shared by the health
+// checks, config reloads and the request handlers.
+type pool struct {
+	mu       sync.RWMutex
+	backends []backend
+	healthy  map[string]bool
+	checks   map[string]*checkState
+	breakers map[string]*breaker
+	// breakerConf is the config of new breakers.
+	breakerConf breakerConfig
+	// checking lists the backends with a running health check loop once
+	// startChecks was called.
+	checking map[string]bool
+
+	// strategy picks a healthy backend for each request. It is set before
+	// the pool starts serving.
+	strategy strategy
+	affinity affinity
+	load     *loadStats
+
+	// routes override the timeouts by path.
+	routes []route
+
+	// retries is the number of times a request may be sent to another
+	// backend after the first, as far as budget allows.
+	retries int
+	budget  *retryBudget
+}
+
+// newPool returns a pool balancing by client IP, with all backends
+// unhealthy until checked.
+func newPool(backends []backend) *pool {
+	p := &pool{
+		strategy: newClientHash(defaultVirtualNodes, affinity{}),
+		load:     newLoadStats(),
+		retries:  defaultRetries,
+		budget:   newRetryBudget(defaultRetryBudget),
+
+		breakerConf: defaultBreakerConfig,
+	}
+	p.update(backends)
+	return p
+}
+
+// setStrategy switches the pool to the strategy called name, keeping
+// clients by aff on a ring of vnodes points per unit of weight if the
+// strategy hashes them. Only client-hash takes an affinity other than the
+// client IP.
+func (p *pool) setStrategy(name string, vnodes int, aff affinity) error {
+	if name != strategyClientHash && aff.kind != "" && aff.kind != affinityIP {
+		return fmt.Errorf("affinity %s needs the %s strategy", aff.kind, strategyClientHash)
+	}
+	s, err := newStrategy(name, p.load, vnodes, aff)
 	if err != nil {
-		return false
+		return err
+	}
+	p.strategy, p.affinity = s, aff
+	return nil
+}
+
+// update replaces the configured backends. Backends that stay keep their
+// health and breaker, new ones are unhealthy until checked.
+func (p *pool) update(backends []backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	healthy := make(map[string]bool)
+	checks := make(map[string]*checkState)
+	breakers := make(map[string]*breaker)
+	for _, b := range backends {
+		healthy[b.Addr] = p.healthy[b.Addr]
+		checks[b.Addr] = p.checks[b.Addr]
+		if checks[b.Addr] == nil {
+			checks[b.Addr] = new(checkState)
+		}
+		breakers[b.Addr] = p.breakers[b.Addr]
+		if breakers[b.Addr] == nil {
+			breakers[b.Addr] = newBreaker(b.Addr, p.breakerConf)
+		}
+	}
+	p.backends = backends
+	p.healthy = healthy
+	p.checks = checks
+	p.breakers = breakers
+	p.startLoops()
+	log.Printf("Backend pool updated: %d backends", len(backends))
+}
+
+// setHealthy sets the health of server and logs state changes. Servers
+// removed in the meantime are ignored.
+func (p *pool) setHealthy(server string, ok bool) {
+	p.mu.Lock()
+	was, known := p.healthy[server]
+	if known {
+		p.healthy[server] = ok
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	p.mu.Unlock()
+	if known && was != ok {
+		log.Println(server, "healthy:", ok)
 	}
-	return true
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
+// snapshot returns the configured backends.
+func (p *pool) snapshot() []backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// healthyBackends returns the backends that passed the last health check
+// and are not ejected by their breaker, in the pool order.
+func (p *pool) healthyBackends() []backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var res []backend
+	for _, b := range p.backends {
+		if p.healthy[b.Addr] && p.breakers[b.Addr].available() {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// without returns backends except server.
+func without(backends []backend, server string) []backend {
+	res := make([]backend, 0, len(backends))
+	for _, b := range backends {
+		if b.Addr != server {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// healthyServers returns the addresses of the healthy backends.
+func (p *pool) healthyServers() []string {
+	var res []string
+	for _, b := range p.healthyBackends() {
+		res = append(res, b.Addr)
+	}
+	return res
+}
+
+// handler forwards requests to a healthy server chosen by the strategy,
+// failing over to others as the retry policy allows, or answers 503 when
+// there is none.
+func (p *pool) handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r = p.affinity.stick(rw, r)
+		healthy := p.healthyBackends()
+		server, ok := p.pick(healthy, r)
+		if !ok {
+			http.Error(rw, "no healthy backends", http.StatusServiceUnavailable)
+			return
+		}
+		p.budget.request()
+
+		limits := p.timeoutsFor(r.URL.Path)
+		fwd := r
+		if limits.Total > 0 {
+			// The total limit covers all attempts, switched protocols aside.
+			if upgradeType(r.Header) == "" {
+				ctx, cancel := context.WithTimeoutCause(r.Context(), time.Duration(limits.Total), errTotalTimeout)
+				defer cancel()
+				fwd = r.WithContext(ctx)
 			}
+			// Leave the server time to answer a route longer than its own
+			// write timeout allows.
+			http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(time.Duration(limits.Total) + time.Second))
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+
+		for attempt := 1; ; attempt++ {
+			end := p.load.begin(server)
+			resp, err := forward(server, fwd, limits)
+			p.observe(server, r, resp, err)
+
+			healthy = without(healthy, server)
+			if attempt <= p.retries && retryable(r, resp, err) {
+				// Budget is only spent on retries that have a backend to go to.
+				if next, ok := p.pick(healthy, r); ok {
+					if p.budget.retry() {
+						if resp != nil {
+							resp.Body.Close()
+						}
+						end()
+						server = next
+						continue
+					}
+					p.breaker(next).release()
+				}
+			}
+
+			if *traceEnabled {
+				rw.Header().Set("lb-attempts", strconv.Itoa(attempt))
+			}
+			var timeoutErr *timeoutError
+			switch {
+			case errors.As(err, &timeoutErr):
+				rw.WriteHeader(http.StatusGatewayTimeout)
+			case err != nil:
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				copyResponse(server, rw, resp)
+			}
+			end()
+			return
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+	})
+}
+
+// pick chooses a backend among candidates with the strategy, passing over
+// the ones whose breaker lets no more requests through.
+func (p *pool) pick(candidates []backend, r *http.Request) (string, bool) {
+	for len(candidates) > 0 {
+		server := p.strategy.choose(candidates, r).Addr
+		if p.breaker(server).acquire() {
+			return server, true
 		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
+		candidates = without(candidates, server)
 	}
+	return "", false
 }
 
-// chooseServer вибирає сервер на основі хешу адреси клієнта
-func chooseServer(remoteAddr string) string {
-	hash := sha1.Sum([]byte(remoteAddr))
-	idx := binary.BigEndian.Uint32(hash[:4]) % uint32(len(serversPool))
-	return serversPool[idx]
+// observe logs a failed request to server and feeds its outcome to the
+// breaker. Errors and 5xx answers are failures; requests cancelled by the
+// client tell nothing about the backend.
+func (p *pool) observe(server string, r *http.Request, resp *http.Response, err error) {
+	b := p.breaker(server)
+	switch {
+	case err != nil && r.Context().Err() != nil:
+		b.release()
+	case err != nil:
+		log.Printf("Failed to get response from %s: %s", server, err)
+		b.record(true)
+	default:
+		b.record(resp.StatusCode >= http.StatusInternalServerError)
+	}
+}
+
+// breaker returns the breaker of server, or nil if it was removed.
+func (p *pool) breaker(server string) *breaker {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.breakers[server]
 }
 
 func main() {
 	flag.Parse()
 
-	for _, server := range serversPool {
-		server := server
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				log.Println(server, "healthy:", health(server))
-			}
-		}()
+	defaultTimeouts = flagTimeouts()
+	initial, err := loadPool()
+	if err != nil {
+		log.Fatalf("Cannot load backends: %s", err)
+	}
+	backends := newPool(initial.Backends)
+	backends.setRoutes(initial.Routes)
+	aff, err := parseAffinity(*affinitySpec)
+	if err != nil {
+		log.Fatalf("Cannot parse the affinity: %s", err)
+	}
+	if err := backends.setStrategy(*strategyName, *virtualNodes, aff); err != nil {
+		log.Fatalf("Cannot set the strategy: %s", err)
 	}
+	backends.setRetries(*retryLimit, *retryRatio)
+	backends.setBreaker(breakerConfig{
+		failures:  *breakerFailures,
+		errorRate: *breakerErrorRate,
+		window:    *breakerWindow,
+		cooldown:  *breakerCooldown,
+	})
+	backends.checkAll()
+	backends.startChecks()
+	go watchConfig(backends)
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		server := chooseServer(r.RemoteAddr)
-		forward(server, rw, r)
-	}))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lb/metrics", backends.handleMetrics)
+	mux.HandleFunc("/lb/status", backends.handleStatus)
+	mux.Handle("/", backends.handler())
+	frontend := httptools.CreateServer(*port, mux)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
 }
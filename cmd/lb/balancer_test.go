@@ -2,26 +2,79 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestChooseServer_ConsistentHashing(t *testing.T) {
-	addr := "192.168.1.100:12345"
-	server1 := chooseServer(addr)
-	server2 := chooseServer(addr)
+// testBackend is an httptest server whose /health answer can be flipped.
+type testBackend struct {
+	*httptest.Server
+	healthy atomic.Bool
+}
+
+func newTestBackend(t *testing.T, name string) *testBackend {
+	b := new(testBackend)
+	b.healthy.Store(true)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if !b.healthy.Load() {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		rw.Header().Set("backend", name)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
 
-	assert.Equal(t, server1, server2, "Same address should map to the same server")
+func (b *testBackend) addr() string {
+	return strings.TrimPrefix(b.URL, "http://")
 }
 
-func TestChooseServer_Distribution(t *testing.T) {
-	hits := make(map[string]int)
-	for i := 0; i < 1000; i++ {
-		addr := fmt.Sprintf("10.0.0.%d", i%255)
-		server := chooseServer(addr)
-		hits[server]++
+func TestPool_HealthAwareRouting(t *testing.T) {
+	b1, b2 := newTestBackend(t, "b1"), newTestBackend(t, "b2")
+	p := newPool([]backend{{Addr: b1.addr(), Weight: 1, HealthPath: "/health"}, {Addr: b2.addr(), Weight: 1, HealthPath: "/health"}})
+	handler := p.handler()
+
+	served := func() map[string]int {
+		hits := make(map[string]int)
+		for i := 0; i < 50; i++ {
+			req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+			req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code == http.StatusOK {
+				hits[rec.Header().Get("backend")]++
+			} else {
+				hits[fmt.Sprint(rec.Code)]++
+			}
+		}
+		return hits
 	}
 
-	assert.GreaterOrEqual(t, len(hits), 2, "Expected requests to be distributed across at least 2 servers")
-}
\ No newline at end of file
+	assert.Equal(t, map[string]int{"503": 50}, served(), "Unchecked servers must not get traffic")
+
+	p.checkAll()
+	hits := served()
+	assert.Greater(t, hits["b1"], 0)
+	assert.Greater(t, hits["b2"], 0)
+
+	b1.healthy.Store(false)
+	p.checkAll()
+	assert.Equal(t, []string{b2.addr()}, p.healthyServers())
+	assert.Equal(t, map[string]int{"b2": 50}, served())
+
+	b2.healthy.Store(false)
+	p.checkAll()
+	assert.Equal(t, map[string]int{"503": 50}, served())
+
+	b1.healthy.Store(true)
+	p.checkAll()
+	assert.Equal(t, map[string]int{"b1": 50}, served())
+}
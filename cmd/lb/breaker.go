@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// circuitState is the state of the circuit breaker of a backend.
+type circuitState int
+
+const (
+	// circuitClosed lets all requests through.
+	circuitClosed circuitState = iota
+	// circuitOpen ejects the backend until the cool-down passes.
+	circuitOpen
+	// circuitHalfOpen lets one probe request through to decide whether
+	// the backend is back.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerConfig tells when circuit breakers open and for how long.
+type breakerConfig struct {
+	// failures is the number of consecutive failures that opens the circuit.
+	failures int
+	// errorRate is the share of failures among the last window requests
+	// that opens the circuit.
+	errorRate float64
+	window    int
+	// cooldown is how long the circuit stays open before a probe.
+	cooldown time.Duration
+}
+
+var defaultBreakerConfig = breakerConfig{
+	failures:  5,
+	errorRate: 0.5,
+	window:    20,
+	cooldown:  10 * time.Second,
+}
+
+// breaker watches the outcome of live requests to one backend and ejects it
+// from the pool when they fail, independently of the active health checks.
+type breaker struct {
+	server string
+	conf   breakerConfig
+
+	mu          sync.Mutex
+	state       circuitState
+	consecutive int
+	// outcomes is a ring of the last requests, true for failures; failed
+	// counts the failures in it.
+	outcomes []bool
+	next     int
+	failed   int
+	openedAt time.Time
+	probing  bool
+
+	ejections    uint64
+	restorations uint64
+}
+
+func newBreaker(server string, conf breakerConfig) *breaker {
+	return &breaker{server: server, conf: conf}
+}
+
+// available tells whether the backend may get requests, without claiming
+// the probe of a half-open circuit. A nil breaker, of a backend removed in
+// the meantime, is always available.
+func (b *breaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return time.Since(b.openedAt) >= b.conf.cooldown
+	case circuitHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// acquire lets a request through. Once the cool-down has passed, the first
+// request becomes the probe and the others are refused until its outcome
+// is recorded.
+func (b *breaker) acquire() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.conf.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record takes the outcome of a request let through by acquire.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.open("probe failed")
+			return
+		}
+		b.reset()
+		b.state = circuitClosed
+		b.restorations++
+		log.Printf("Backend %s restored: probe succeeded", b.server)
+	case circuitClosed:
+		if b.conf.window > 0 {
+			b.push(failed)
+		}
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.consecutive++
+		switch {
+		case b.conf.failures > 0 && b.consecutive >= b.conf.failures:
+			b.open("consecutive failures")
+			b.ejections++
+		case b.conf.window > 0 && len(b.outcomes) == b.conf.window &&
+			float64(b.failed) >= b.conf.errorRate*float64(b.conf.window):
+			b.open("error rate")
+			b.ejections++
+		}
+	}
+	// Requests let through before the circuit opened do not count.
+}
+
+// push adds an outcome to the window, dropping the oldest once it is full.
+func (b *breaker) push(failed bool) {
+	if len(b.outcomes) < b.conf.window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failed--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.conf.window
+	}
+	if failed {
+		b.failed++
+	}
+}
+
+// release gives up the probe of a half-open circuit without an outcome, for
+// requests abandoned by the client.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) open(reason string) {
+	if b.state == circuitClosed {
+		log.Printf("Backend %s ejected: %s (%d consecutive, %d of last %d failed)",
+			b.server, reason, b.consecutive, b.failed, len(b.outcomes))
+	} else {
+		log.Printf("Backend %s stays ejected: %s", b.server, reason)
+	}
+	b.reset()
+	b.state = circuitOpen
+	b.openedAt = time.Now()
+}
+
+func (b *breaker) reset() {
+	b.consecutive, b.failed, b.next = 0, 0, 0
+	b.outcomes = b.outcomes[:0]
+}
+
+// breakerStats is a snapshot of a breaker for metrics and status pages.
+type breakerStats struct {
+	state        circuitState
+	ejections    uint64
+	restorations uint64
+}
+
+func (b *breaker) stats() breakerStats {
+	if b == nil {
+		return breakerStats{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStats{state: b.state, ejections: b.ejections, restorations: b.restorations}
+}
+
+// setBreaker replaces the breakers of all backends with ones using conf.
+func (p *pool) setBreaker(conf breakerConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breakerConf = conf
+	for server := range p.breakers {
+		p.breakers[server] = newBreaker(server, conf)
+	}
+}
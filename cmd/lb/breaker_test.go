@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	b := newBreaker("a:8080", breakerConfig{failures: 3, cooldown: 20 * time.Millisecond})
+	for _, failed := range []bool{true, true, false, true, true} {
+		require.True(t, b.acquire())
+		b.record(failed)
+	}
+	assert.Equal(t, circuitClosed, b.stats().state)
+
+	require.True(t, b.acquire())
+	b.record(true)
+	assert.Equal(t, circuitOpen, b.stats().state)
+	assert.False(t, b.available())
+	assert.False(t, b.acquire())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.available())
+	assert.True(t, b.acquire(), "No probe after the cool-down")
+	assert.False(t, b.acquire(), "A second probe was let through")
+	b.record(true)
+	assert.Equal(t, circuitOpen, b.stats().state, "A failed probe closed the circuit")
+
+	time.Sleep(20 * time.Millisecond)
+	require.True(t, b.acquire())
+	b.record(false)
+	assert.Equal(t, breakerStats{state: circuitClosed, ejections: 1, restorations: 1}, b.stats())
+	assert.True(t, b.acquire())
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b := newBreaker("a:8080", breakerConfig{errorRate: 0.5, window: 10, cooldown: time.Minute})
+	for i := 0; i < 9; i++ {
+		b.record(i%2 == 1)
+	}
+	assert.Equal(t, circuitClosed, b.stats().state, "Opened before the window filled")
+
+	// The oldest outcomes drop out of the window.
+	for i := 0; i < 20; i++ {
+		b.record(i%4 == 3)
+	}
+	assert.Equal(t, circuitClosed, b.stats().state)
+
+	for i := 0; i < 3; i++ {
+		b.record(true)
+	}
+	assert.Equal(t, circuitOpen, b.stats().state)
+}
+
+func TestBreaker_ReleasedProbe(t *testing.T) {
+	b := newBreaker("a:8080", breakerConfig{failures: 1})
+	b.record(true)
+	require.True(t, b.acquire())
+	b.release()
+	assert.True(t, b.acquire(), "An abandoned probe blocked the backend")
+}
+
+func TestPool_PassiveEjection(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("backend", "flaky")
+		if broken.Load() {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(flaky.Close)
+	flakyAddr := strings.TrimPrefix(flaky.URL, "http://")
+	good := newTestBackend(t, "good")
+
+	p := retryPool(t, flakyAddr, good.addr())
+	p.setRetries(0, defaultRetryBudget)
+	p.setBreaker(breakerConfig{failures: 2, cooldown: 50 * time.Millisecond})
+	handler := p.handler()
+	served := func(n int) map[string]int {
+		hits := make(map[string]int)
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			hits[fmt.Sprintf("%s %d", rec.Header().Get("backend"), rec.Code)]++
+		}
+		return hits
+	}
+
+	assert.Equal(t, map[string]int{"flaky 500": 2, "good 200": 2}, served(4))
+	assert.Equal(t, []string{good.addr()}, p.healthyServers())
+	assert.Equal(t, map[string]int{"good 200": 10}, served(10))
+
+	broken.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]int{"flaky 200": 5, "good 200": 5}, served(10))
+
+	var metrics strings.Builder
+	p.writeMetrics(&metrics)
+	for _, line := range []string{
+		fmt.Sprintf("lb_backend_ejections_total{backend=%q} 1", flakyAddr),
+		fmt.Sprintf("lb_backend_restorations_total{backend=%q} 1", flakyAddr),
+		fmt.Sprintf("lb_backend_circuit_state{backend=%q} 0", flakyAddr),
+		fmt.Sprintf("lb_backend_ejections_total{backend=%q} 0", good.addr()),
+	} {
+		assert.Contains(t, metrics.String(), line+"\n")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+const defaultHealthPath = "/health"
+
+// Defaults of the active health checks of a backend.
+const (
+	defaultHealthInterval     = 10 * time.Second
+	defaultHealthStatus       = http.StatusOK
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+)
+
+// backend is a server of the pool as configured.
+type backend struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// Weight is the share of traffic relative to other backends.
+	Weight     int    `yaml:"weight" json:"weight"`
+	HealthPath string `yaml:"health_path" json:"health_path"`
+	// HealthInterval is the time between health checks, give or take a
+	// tenth so that backends are not all checked at once.
+	HealthInterval duration `yaml:"health_interval" json:"health_interval"`
+	// HealthTimeout is how long a check may take; zero means -timeout-sec.
+	HealthTimeout duration `yaml:"health_timeout" json:"health_timeout"`
+	HealthStatus  int      `yaml:"health_status" json:"health_status"`
+	// HealthBody, if set, must occur in the body of a passing check.
+	HealthBody string `yaml:"health_body" json:"health_body"`
+	// HealthyThreshold and UnhealthyThreshold are the numbers of
+	// consecutive passed or failed checks that change the verdict. The
+	// first check of a backend decides on its own.
+	HealthyThreshold   int `yaml:"healthy_threshold" json:"healthy_threshold"`
+	UnhealthyThreshold int `yaml:"unhealthy_threshold" json:"unhealthy_threshold"`
+}
+
+// duration is a time.Duration written as "5s" in config files.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// poolConfig is the content of the -config file, YAML or JSON:
+//
+//	backends:
+//	  - addr: server1:8080
+//	    weight: 2
+//	    health_path: /health
+//	    health_interval: 5s
+//	    health_timeout: 1s
+//	    health_status: 200
+//	    health_body: ok
+//	    healthy_threshold: 2
+//	    unhealthy_threshold: 3
+//	routes:
+//	  - prefix: /api/v1/some-data
+//	    timeout: 30s
+//	    response_header_timeout: 25s
+//	    connect_timeout: 1s
+type poolConfig struct {
+	Backends []backend `yaml:"backends" json:"backends"`
+	// Routes override the timeouts by path, after the ones of
+	// -route-timeouts.
+	Routes []route `yaml:"routes" json:"routes"`
+}
+
+// parseBackendList parses the -backends flag: comma-separated addresses,
+// each optionally followed by @weight.
+func parseBackendList(list string) ([]backend, error) {
+	var res []backend
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		b := backend{Addr: item}
+		if addr, weight, ok := strings.Cut(item, "@"); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil {
+				return nil, fmt.Errorf("bad weight of %s: %w", addr, err)
+			}
+			b.Addr, b.Weight = addr, w
+		}
+		res = append(res, b)
+	}
+	return normalizeBackends(res)
+}
+
+// loadConfig reads a pool config file. Files ending in .json are JSON,
+// anything else is YAML.
+func loadConfig(path string) (poolConfig, error) {
+	var conf poolConfig
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(content, &conf)
+	} else {
+		err = yaml.Unmarshal(content, &conf)
+	}
+	if err != nil {
+		return conf, fmt.Errorf("%s: %w", path, err)
+	}
+	if conf.Backends, err = normalizeBackends(conf.Backends); err != nil {
+		return conf, err
+	}
+	conf.Routes, err = normalizeRoutes(conf.Routes)
+	return conf, err
+}
+
+// normalizeBackends fills in defaults and rejects unusable entries.
+func normalizeBackends(backends []backend) ([]backend, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	seen := make(map[string]bool)
+	for i := range backends {
+		b := &backends[i]
+		if b.Addr == "" {
+			return nil, fmt.Errorf("backend %d has no address", i+1)
+		}
+		if seen[b.Addr] {
+			return nil, fmt.Errorf("backend %s is listed twice", b.Addr)
+		}
+		seen[b.Addr] = true
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("backend %s has a negative weight", b.Addr)
+		}
+		if b.HealthPath == "" {
+			b.HealthPath = defaultHealthPath
+		}
+		if !strings.HasPrefix(b.HealthPath, "/") {
+			b.HealthPath = "/" + b.HealthPath
+		}
+		if b.HealthInterval < 0 || b.HealthTimeout < 0 || b.HealthyThreshold < 0 || b.UnhealthyThreshold < 0 {
+			return nil, fmt.Errorf("backend %s has a negative health check setting", b.Addr)
+		}
+		if b.HealthInterval == 0 {
+			b.HealthInterval = duration(defaultHealthInterval)
+		}
+		if b.HealthStatus == 0 {
+			b.HealthStatus = defaultHealthStatus
+		}
+		if b.HealthyThreshold == 0 {
+			b.HealthyThreshold = defaultHealthyThreshold
+		}
+		if b.UnhealthyThreshold == 0 {
+			b.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+	}
+	return backends, nil
+}
+
+// loadPool reads the backends from -config if it is set, or from -backends,
+// and the routes from -route-timeouts and -config.
+func loadPool() (poolConfig, error) {
+	routes, err := parseRouteTimeouts(*routeTimeouts)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	if *configPath != "" {
+		conf, err := loadConfig(*configPath)
+		conf.Routes = append(routes, conf.Routes...)
+		return conf, err
+	}
+	backends, err := parseBackendList(*backendList)
+	return poolConfig{Backends: backends, Routes: routes}, err
+}
+
+// watchConfig reloads the pool on SIGHUP and, with -config set, whenever the
+// file changes. Requests already forwarded are not affected by a reload.
+func watchConfig(p *pool) {
+	hup := signal.NotifyHangup()
+	ticker := time.NewTicker(*reloadInterval)
+	defer ticker.Stop()
+
+	lastMod := configModTime()
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading backends")
+		case <-ticker.C:
+			mod := configModTime()
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			log.Println("Config file changed, reloading backends")
+		}
+		conf, err := loadPool()
+		if err != nil {
+			log.Printf("Cannot reload backends, keeping the old ones: %s", err)
+			continue
+		}
+		p.update(conf.Backends)
+		p.setRoutes(conf.Routes)
+		p.checkAll()
+	}
+}
+
+func configModTime() time.Time {
+	if *configPath == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(*configPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withCheckDefaults fills in the default health check settings.
+func withCheckDefaults(b backend) backend {
+	b.HealthInterval = duration(defaultHealthInterval)
+	b.HealthStatus = defaultHealthStatus
+	b.HealthyThreshold = defaultHealthyThreshold
+	b.UnhealthyThreshold = defaultUnhealthyThreshold
+	return b
+}
+
+func TestParseBackendList(t *testing.T) {
+	backends, err := parseBackendList("a:8080, b:8080@3,")
+	require.NoError(t, err)
+	assert.Equal(t, []backend{
+		withCheckDefaults(backend{Addr: "a:8080", Weight: 1, HealthPath: "/health"}),
+		withCheckDefaults(backend{Addr: "b:8080", Weight: 3, HealthPath: "/health"}),
+	}, backends)
+
+	_, err = parseBackendList("a:8080@x")
+	assert.Error(t, err)
+	_, err = parseBackendList("a:8080,a:8080")
+	assert.Error(t, err)
+	_, err = parseBackendList("")
+	assert.Error(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	expected := []backend{
+		{
+			Addr:               "a:8080",
+			Weight:             2,
+			HealthPath:         "/ready",
+			HealthInterval:     duration(5 * time.Second),
+			HealthTimeout:      duration(500 * time.Millisecond),
+			HealthStatus:       http.StatusNoContent,
+			HealthBody:         "ok",
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+		},
+		withCheckDefaults(backend{Addr: "b:8080", Weight: 1, HealthPath: "/health"}),
+	}
+
+	yamlPath := filepath.Join(dir, "pool.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte(`
+backends:
+  - addr: a:8080
+    weight: 2
+    health_path: ready
+    health_interval: 5s
+    health_timeout: 500ms
+    health_status: 204
+    health_body: ok
+    healthy_threshold: 1
+    unhealthy_threshold: 2
+  - addr: b:8080
+`), 0o600))
+	conf, err := loadConfig(yamlPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, conf.Backends)
+
+	jsonPath := filepath.Join(dir, "pool.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"backends": [
+		{"addr": "a:8080", "weight": 2, "health_path": "/ready", "health_interval": "5s",
+		 "health_timeout": "500ms", "health_status": 204, "health_body": "ok",
+		 "healthy_threshold": 1, "unhealthy_threshold": 2},
+		{"addr": "b:8080"}
+	]}`), 0o600))
+	conf, err = loadConfig(jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, conf.Backends)
+}
+
+func TestPool_UpdateKeepsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			close(started)
+			<-release
+		}
+	}))
+	t.Cleanup(slow.Close)
+	other := newTestBackend(t, "other")
+
+	p := newPool([]backend{{Addr: strings.TrimPrefix(slow.URL, "http://"), Weight: 1, HealthPath: "/health"}})
+	p.checkAll()
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+		done <- rec.Code
+	}()
+	<-started
+
+	// The slow backend leaves the pool while serving a request.
+	p.update([]backend{{Addr: other.addr(), Weight: 1, HealthPath: "/health"}})
+	p.checkAll()
+	assert.Equal(t, []string{other.addr()}, p.healthyServers())
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
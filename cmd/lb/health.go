@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHealthBody is how much of a health check answer is searched for the
+// expected body or drained to reuse the connection.
+const maxHealthBody = 64 << 10
+
+// checkResult is the outcome of one health check.
+type checkResult struct {
+	Time     time.Time `json:"time"`
+	Duration duration  `json:"duration"`
+	OK       bool      `json:"ok"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// checkState is the health check history of a backend.
+type checkState struct {
+	// successes and failures count the consecutive passed and failed
+	// checks.
+	successes int
+	failures  int
+	last      *checkResult
+}
+
+// check runs one health check of b.
+func check(b backend) (res checkResult) {
+	res.Time = time.Now()
+	defer func() {
+		res.Duration = duration(time.Since(res.Time))
+	}()
+
+	limit := time.Duration(b.HealthTimeout)
+	if limit == 0 {
+		limit = time.Duration(defaultTimeouts.Total)
+	}
+	if limit == 0 {
+		limit = defaultHealthInterval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", scheme(), b.Addr, b.HealthPath), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer func() {
+		// Draining the answer lets the connection be reused.
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBody))
+		resp.Body.Close()
+	}()
+
+	res.Status = resp.StatusCode
+	expected := b.HealthStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		res.Error = fmt.Sprintf("expected status %d", expected)
+		return res
+	}
+	if b.HealthBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if !strings.Contains(string(body), b.HealthBody) {
+			res.Error = fmt.Sprintf("body does not contain %q", b.HealthBody)
+			return res
+		}
+	}
+	res.OK = true
+	return res
+}
+
+// report takes the result of a health check of b. The first result of a
+// backend sets its health; after that it takes the thresholds of b in a row
+// to change it.
+func (p *pool) report(b backend, res checkResult) {
+	p.mu.Lock()
+	state, known := p.checks[b.Addr]
+	if !known {
+		p.mu.Unlock()
+		return
+	}
+	first := state.last == nil
+	state.last = &res
+	if res.OK {
+		state.successes++
+		state.failures = 0
+	} else {
+		state.failures++
+		state.successes = 0
+	}
+	was := p.healthy[b.Addr]
+	switch {
+	case first:
+		p.healthy[b.Addr] = res.OK
+	case !was && state.successes >= max(b.HealthyThreshold, 1):
+		p.healthy[b.Addr] = true
+	case was && state.failures >= max(b.UnhealthyThreshold, 1):
+		p.healthy[b.Addr] = false
+	}
+	now := p.healthy[b.Addr]
+	p.mu.Unlock()
+
+	switch {
+	case was != now && !now:
+		log.Println(b.Addr, "healthy:", now, "-", res.Error)
+	case was != now:
+		log.Println(b.Addr, "healthy:", now)
+	}
+}
+
+// checkAll checks every backend at once and waits for the results.
+func (p *pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.snapshot() {
+		wg.Add(1)
+		go func(b backend) {
+			defer wg.Done()
+			p.report(b, check(b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// startChecks checks every backend, and every one added later, in the
+// background at its own interval.
+func (p *pool) startChecks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checking = make(map[string]bool)
+	p.startLoops()
+}
+
+// startLoops starts the check loops missing since startChecks. It is called
+// with mu held.
+func (p *pool) startLoops() {
+	if p.checking == nil {
+		return
+	}
+	for _, b := range p.backends {
+		if !p.checking[b.Addr] {
+			p.checking[b.Addr] = true
+			go p.checkLoop(b.Addr)
+		}
+	}
+}
+
+// checkLoop checks server until it is removed from the pool, taking its
+// settings anew each time so that reloads apply.
+func (p *pool) checkLoop(server string) {
+	for {
+		b, ok := p.lookup(server)
+		if ok {
+			time.Sleep(jitter(time.Duration(b.HealthInterval)))
+			b, ok = p.lookup(server)
+		}
+		if !ok {
+			p.mu.Lock()
+			// The backend may have come back while the loop slept.
+			if _, ok := p.checks[server]; ok {
+				p.mu.Unlock()
+				continue
+			}
+			delete(p.checking, server)
+			p.mu.Unlock()
+			return
+		}
+		p.report(b, check(b))
+	}
+}
+
+// jitter returns interval give or take a tenth.
+func jitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	return interval + time.Duration((rand.Float64()-0.5)*0.2*float64(interval))
+}
+
+// lookup returns the config of server.
+func (p *pool) lookup(server string) (backend, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, b := range p.backends {
+		if b.Addr == server {
+			return b, true
+		}
+	}
+	return backend{}, false
+}
+
+// backendStatus is the state of a backend as shown by /lb/status.
+type backendStatus struct {
+	Addr     string       `json:"addr"`
+	Weight   int          `json:"weight"`
+	Healthy  bool         `json:"healthy"`
+	Circuit  string       `json:"circuit"`
+	InFlight int          `json:"in_flight"`
+	Passed   int          `json:"consecutive_passed"`
+	Failed   int          `json:"consecutive_failed"`
+	Last     *checkResult `json:"last_check"`
+}
+
+// status returns the state of every backend in the pool order.
+func (p *pool) status() []backendStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]backendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		s := backendStatus{
+			Addr:     b.Addr,
+			Weight:   b.Weight,
+			Healthy:  p.healthy[b.Addr],
+			Circuit:  p.breakers[b.Addr].stats().state.String(),
+			InFlight: p.load.inflight(b.Addr),
+		}
+		if state := p.checks[b.Addr]; state != nil {
+			s.Passed, s.Failed = state.successes, state.failures
+			if state.last != nil {
+				last := *state.last
+				s.Last = &last
+			}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// handleStatus serves the state of the backends as JSON.
+func (p *pool) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string]any{"backends": p.status()}); err != nil {
+		log.Printf("Failed to write status: %s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/created":
+			rw.WriteHeader(http.StatusCreated)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		rw.Write([]byte("status: ok"))
+	}))
+	t.Cleanup(srv.Close)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct {
+		name  string
+		b     backend
+		ok    bool
+		error string
+	}{
+		{"ok", backend{HealthPath: "/health"}, true, ""},
+		{"status", backend{HealthPath: "/created"}, false, "expected status 200"},
+		{"expected status", backend{HealthPath: "/created", HealthStatus: http.StatusCreated}, true, ""},
+		{"body", backend{HealthPath: "/health", HealthBody: "ok"}, true, ""},
+		{"wrong body", backend{HealthPath: "/health", HealthBody: "ready"}, false, `body does not contain "ready"`},
+		{"timeout", backend{HealthPath: "/slow", HealthTimeout: duration(50 * time.Millisecond)}, false, "deadline exceeded"},
+	} {
+		tc.b.Addr = addr
+		res := check(tc.b)
+		assert.Equal(t, tc.ok, res.OK, tc.name)
+		if tc.error == "" {
+			assert.Empty(t, res.Error, tc.name)
+		} else {
+			assert.Contains(t, res.Error, tc.error, tc.name)
+		}
+	}
+}
+
+func TestPool_HealthThresholds(t *testing.T) {
+	tb := newTestBackend(t, "b")
+	b := backend{Addr: tb.addr(), Weight: 1, HealthPath: "/health", HealthyThreshold: 2, UnhealthyThreshold: 3}
+	p := newPool([]backend{b})
+
+	steps := []struct {
+		up       bool
+		expected bool
+	}{
+		{false, false}, // the first check decides
+		{true, false},
+		{true, true},
+		{false, true},
+		{false, true},
+		{true, true}, // a pass resets the failures
+		{false, true},
+		{false, true},
+		{false, false},
+	}
+	for i, step := range steps {
+		tb.healthy.Store(step.up)
+		p.checkAll()
+		assert.Equal(t, step.expected, len(p.healthyServers()) == 1, "step %d", i+1)
+	}
+}
+
+func TestPool_BackgroundChecks(t *testing.T) {
+	tb := newTestBackend(t, "b")
+	p := newPool([]backend{{Addr: tb.addr(), Weight: 1, HealthPath: "/health", HealthInterval: duration(10 * time.Millisecond)}})
+	p.startChecks()
+	t.Cleanup(func() {
+		// Stop the loops, which would outlive the test otherwise.
+		p.update(nil)
+		require.Eventually(t, func() bool {
+			p.mu.RLock()
+			defer p.mu.RUnlock()
+			return len(p.checking) == 0
+		}, time.Second, 5*time.Millisecond)
+	})
+	require.Eventually(t, func() bool {
+		return len(p.healthyServers()) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	tb.healthy.Store(false)
+	require.Eventually(t, func() bool {
+		return len(p.healthyServers()) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	other := newTestBackend(t, "other")
+	p.update([]backend{{Addr: other.addr(), Weight: 1, HealthPath: "/health", HealthInterval: duration(10 * time.Millisecond)}})
+	require.Eventually(t, func() bool {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return !p.checking[tb.addr()] && p.checking[other.addr()]
+	}, time.Second, 5*time.Millisecond, "The check loop of a removed backend kept running")
+	require.Eventually(t, func() bool {
+		return len(p.healthyServers()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(10 * time.Second)
+		assert.InDelta(t, float64(10*time.Second), float64(d), float64(time.Second))
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	up, down := newTestBackend(t, "up"), newTestBackend(t, "down")
+	down.healthy.Store(false)
+	p := newPool([]backend{
+		{Addr: up.addr(), Weight: 2, HealthPath: "/health"},
+		{Addr: down.addr(), Weight: 1, HealthPath: "/health"},
+	})
+	p.checkAll()
+
+	rec := httptest.NewRecorder()
+	p.handleStatus(rec, httptest.NewRequest("GET", "/lb/status", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var status struct {
+		Backends []backendStatus `json:"backends"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Len(t, status.Backends, 2)
+
+	first, second := status.Backends[0], status.Backends[1]
+	assert.Equal(t, up.addr(), first.Addr)
+	assert.Equal(t, 2, first.Weight)
+	assert.True(t, first.Healthy)
+	assert.Equal(t, "closed", first.Circuit)
+	assert.Equal(t, 1, first.Passed)
+	require.NotNil(t, first.Last)
+	assert.True(t, first.Last.OK)
+	assert.Equal(t, http.StatusOK, first.Last.Status)
+
+	assert.False(t, second.Healthy)
+	assert.Equal(t, 1, second.Failed)
+	require.NotNil(t, second.Last)
+	assert.Equal(t, http.StatusInternalServerError, second.Last.Status)
+	assert.Equal(t, "expected status 200", second.Last.Error)
+}
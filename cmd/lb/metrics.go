@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// handleMetrics serves the state of the backends in the Prometheus text
+// exposition format.
+func (p *pool) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.writeMetrics(w)
+}
+
+func (p *pool) writeMetrics(w io.Writer) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	p.mu.RLock()
+	backends := p.backends
+	healthy := make(map[string]bool, len(p.healthy))
+	stats := make(map[string]breakerStats, len(p.breakers))
+	for _, b := range backends {
+		healthy[b.Addr] = p.healthy[b.Addr]
+		stats[b.Addr] = p.breakers[b.Addr].stats()
+	}
+	p.mu.RUnlock()
+
+	metric("lb_backend_up", "gauge", "Whether the backend passed the last active health check.")
+	for _, b := range backends {
+		up := 0
+		if healthy[b.Addr] {
+			up = 1
+		}
+		fmt.Fprintf(w, "lb_backend_up{backend=%q} %d\n", b.Addr, up)
+	}
+	metric("lb_backend_circuit_state", "gauge", "State of the circuit breaker: 0 closed, 1 open, 2 half-open.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_circuit_state{backend=%q} %d\n", b.Addr, stats[b.Addr].state)
+	}
+	metric("lb_backend_ejections_total", "counter", "Times the circuit breaker ejected the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_ejections_total{backend=%q} %d\n", b.Addr, stats[b.Addr].ejections)
+	}
+	metric("lb_backend_restorations_total", "counter", "Times a probe brought the backend back.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_restorations_total{backend=%q} %d\n", b.Addr, stats[b.Addr].restorations)
+	}
+	metric("lb_backend_requests_in_flight", "gauge", "Requests sent to the backend and not answered yet.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_requests_in_flight{backend=%q} %d\n", b.Addr, p.load.inflight(b.Addr))
+	}
+}
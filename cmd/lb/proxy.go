@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// via identifies the balancer in the Via header.
+const via = "lb"
+
+// transport sends the requests to the backends. Unlike http.Client it
+// leaves redirects to the client.
+var transport http.RoundTripper = newTransport()
+
+// hopHeaders are the headers that only concern one connection and are
+// not passed on (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including the
+// ones named in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hasToken tells whether the comma-separated header values contain token.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeType returns the protocol h asks to switch to, if any.
+func upgradeType(h http.Header) string {
+	if !hasToken(h.Values("Connection"), "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// forward sends r to dst as a proxy: without the hop-by-hop headers and
+// with the X-Forwarded-* and Via ones, within the limits of t. A limit
+// running out gives a *timeoutError. Closing the body of the response also
+// releases the request context.
+func forward(dst string, r *http.Request, t timeouts) (*http.Response, error) {
+	// A switched protocol lasts as long as the client wants it to.
+	upgrade := upgradeType(r.Header)
+	ctx, gotHead, cancel := withTimeouts(r.Context(), t, upgrade == "")
+	fwdRequest := r.Clone(ctx)
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = scheme()
+	fwdRequest.Host = dst
+	fwdRequest.Close = false
+	if r.ContentLength == 0 {
+		fwdRequest.Body = nil
+	}
+
+	h := fwdRequest.Header
+	removeHopHeaders(h)
+	if hasToken(r.Header.Values("Te"), "trailers") {
+		h.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if _, ok := h["User-Agent"]; !ok {
+		// Keep Go from adding its own.
+		h.Set("User-Agent", "")
+	}
+	h.Set("X-Forwarded-For", strings.Join(append(r.Header.Values("X-Forwarded-For"), clientIP(r)), ", "))
+	h.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		h.Set("X-Forwarded-Proto", "https")
+	} else {
+		h.Set("X-Forwarded-Proto", "http")
+	}
+	h.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, via))
+
+	resp, err := transport.RoundTrip(fwdRequest)
+	if err == nil && !gotHead() {
+		resp.Body.Close()
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		err = timeoutOf(ctx, t, err)
+		cancel()
+		return nil, err
+	}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = cancelConn{conn, cancel}
+	} else {
+		resp.Body = cancelBody{resp.Body, cancel}
+	}
+	return resp, nil
+}
+
+// cancelBody cancels the context of a request when its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// cancelConn is a cancelBody for the connection of a switched protocol.
+type cancelConn struct {
+	io.ReadWriteCloser
+	cancel func()
+}
+
+func (c cancelConn) Close() error {
+	defer c.cancel()
+	return c.ReadWriteCloser.Close()
+}
+
+// copyResponse writes resp from dst to rw and closes its body. Responses of
+// unknown length are flushed as they come, trailers follow the body and a
+// switch of protocol turns the connection into a tunnel to dst.
+func copyResponse(dst string, rw http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		tunnel(dst, rw, resp)
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.Header().Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, via))
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+	// Trailers the backend announced are announced to the client too.
+	announced := len(resp.Trailer)
+	for name := range resp.Trailer {
+		rw.Header().Add("Trailer", name)
+	}
+	rw.WriteHeader(resp.StatusCode)
+
+	if err := copyBody(rw, resp); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+
+	if len(resp.Trailer) == announced {
+		for k, values := range resp.Trailer {
+			rw.Header()[k] = values
+		}
+		return
+	}
+	for k, values := range resp.Trailer {
+		rw.Header()[http.TrailerPrefix+k] = values
+	}
+}
+
+// copyBody copies the body of resp to rw, flushing after every read when the
+// length of the body is unknown, as with streamed responses.
+func copyBody(rw http.ResponseWriter, resp *http.Response) error {
+	stream := resp.ContentLength == -1
+	rc := http.NewResponseController(rw)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if stream && rc.Flush() != nil {
+				// Writers that cannot flush get the rest in one go.
+				stream = false
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tunnel answers a switch of protocol, such as a WebSocket handshake, and
+// then copies bytes both ways between the client and dst until either side
+// closes.
+func tunnel(dst string, rw http.ResponseWriter, resp *http.Response) {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("Backend %s switched protocols without a connection", dst)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		log.Printf("Cannot take over the connection to switch protocols: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// The timeouts of the server are meant for requests, not tunnels.
+	conn.SetDeadline(time.Time{})
+
+	for k, values := range rw.Header() {
+		if _, ok := resp.Header[k]; !ok {
+			resp.Header[k] = values
+		}
+	}
+	if *traceEnabled {
+		resp.Header.Set("lb-from", dst)
+	}
+	resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, via))
+	head := *resp
+	head.Body = nil
+	if err := head.Write(brw); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	// Bytes the client sent after the request may wait in brw.
+	go copyHalf(backConn, brw)
+	go copyHalf(conn, backConn)
+	<-done
+}
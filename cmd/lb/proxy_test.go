@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyTo starts the balancer in front of a backend with handler and
+// returns the backend and the balancer address.
+func proxyTo(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *httptest.Server) {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	p := retryPool(t, strings.TrimPrefix(backend.URL, "http://"))
+	frontend := httptest.NewServer(p.handler())
+	t.Cleanup(frontend.Close)
+	return backend, frontend
+}
+
+func TestProxy_Headers(t *testing.T) {
+	var seen http.Header
+	_, frontend := proxyTo(t, func(rw http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		rw.Header().Set("Connection", "X-Backend-Hop")
+		rw.Header().Set("X-Backend-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("X-Backend", "kept")
+	})
+
+	req, _ := http.NewRequest("GET", frontend.URL+"/api/v1/some-data", nil)
+	req.Host = "example.com"
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Forwarded-For", "192.168.1.7")
+	req.Header.Set("X-Client", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+		assert.Empty(t, seen.Get(name), "%s reached the backend", name)
+	}
+	assert.Equal(t, "kept", seen.Get("X-Client"))
+	assert.Equal(t, "192.168.1.7, 127.0.0.1", seen.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", seen.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", seen.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "1.1 lb", seen.Get("Via"))
+
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive"} {
+		assert.Empty(t, resp.Header.Get(name), "%s reached the client", name)
+	}
+	assert.Equal(t, "kept", resp.Header.Get("X-Backend"))
+	assert.Equal(t, "1.1 lb", resp.Header.Get("Via"))
+}
+
+func TestProxy_RedirectNotFollowed(t *testing.T) {
+	_, frontend := proxyTo(t, func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "/elsewhere", http.StatusFound)
+	})
+
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(frontend.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/elsewhere", resp.Header.Get("Location"))
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	_, frontend := proxyTo(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(rw, "data: first\n\n")
+		rw.(http.Flusher).Flush()
+		<-release
+		io.WriteString(rw, "data: second\n\n")
+	})
+	defer close(release)
+
+	resp, err := http.Get(frontend.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		assert.Equal(t, "data: first\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("The first event was held back until the response ended")
+	}
+}
+
+func TestProxy_Trailers(t *testing.T) {
+	_, frontend := proxyTo(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(rw, "body")
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	})
+
+	resp, err := http.Get(frontend.URL + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "def", resp.Trailer.Get("X-Late"))
+}
+
+func TestProxy_Upgrade(t *testing.T) {
+	_, frontend := proxyTo(t, func(rw http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			http.Error(rw, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo " + line)
+			brw.Flush()
+		}
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		io.WriteString(conn, msg)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo "+msg, line)
+	}
+}
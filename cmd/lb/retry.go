@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	defaultRetries     = 2
+	defaultRetryBudget = 0.2
+	// retryBudgetBurst caps the retries saved up while backends were fine.
+	retryBudgetBurst = 10
+)
+
+// setRetries lets a failed request go to up to limit other backends, with
+// ratio retries per request on average.
+func (p *pool) setRetries(limit int, ratio float64) {
+	p.retries = limit
+	p.budget = newRetryBudget(ratio)
+}
+
+// retryable tells whether a request that got resp or err may be sent to
+// another backend. Requests with a body are never retried, as the body is
+// gone. Requests that never reached the backend are retried whatever the
+// method; the others only if the method is idempotent and the backend
+// failed or said it cannot serve. A backend that ran out of time is not
+// retried, as the limit is the one of the whole request; one that could not
+// be connected to in time is, like any failed connection.
+func retryable(r *http.Request, resp *http.Response, err error) bool {
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		return false
+	}
+	if err != nil {
+		var timeoutErr *timeoutError
+		if errors.As(err, &timeoutErr) && timeoutErr.stage != "connect" {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return idempotent(r.Method)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(r.Method)
+	}
+	return false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryBudget keeps retries to a share of the requests, so that a failing
+// backend does not get every request it failed sent on to the others on top
+// of the regular traffic. Each request earns ratio of a retry, up to
+// retryBudgetBurst, and each retry spends one.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, balance: retryBudgetBurst}
+}
+
+// request credits the budget for a new request.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance = min(b.balance+b.ratio, retryBudgetBurst)
+}
+
+// retry spends a retry and tells whether there was one left.
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadAddr returns an address nothing listens on.
+func deadAddr(t *testing.T) string {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	return strings.TrimPrefix(dead.URL, "http://")
+}
+
+// retryPool returns a round robin pool of servers, all taken as healthy.
+func retryPool(t *testing.T, servers ...string) *pool {
+	var backends []backend
+	for _, s := range servers {
+		backends = append(backends, backend{Addr: s, Weight: 1})
+	}
+	p := newPool(backends)
+	require.NoError(t, p.setStrategy(strategyRoundRobin, defaultVirtualNodes, affinity{}))
+	for _, s := range servers {
+		p.setHealthy(s, true)
+	}
+	return p
+}
+
+func enableTrace(t *testing.T) {
+	*traceEnabled = true
+	t.Cleanup(func() {
+		*traceEnabled = false
+	})
+}
+
+func TestPool_FailoverOnConnectionError(t *testing.T) {
+	enableTrace(t)
+	good := newTestBackend(t, "good")
+	p := retryPool(t, deadAddr(t), good.addr())
+	handler := p.handler()
+
+	for _, method := range []string{"GET", "POST"} {
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/some-data", nil))
+			assert.Equal(t, http.StatusOK, rec.Code, method)
+			assert.Equal(t, "good", rec.Header().Get("backend"))
+			assert.Contains(t, []string{"1", "2"}, rec.Header().Get("lb-attempts"))
+		}
+	}
+}
+
+func TestPool_RetryOnUnavailable(t *testing.T) {
+	enableTrace(t)
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+	good := newTestBackend(t, "good")
+	p := retryPool(t, strings.TrimPrefix(unavailable.URL, "http://"), good.addr())
+	handler := p.handler()
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+		return rec
+	}
+
+	// Round robin takes the unavailable backend first each time, as every
+	// retry moves it on as well.
+	for i := 0; i < 2; i++ {
+		rec := serve("GET")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("lb-attempts"))
+	}
+
+	rec := serve("POST")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "A POST was retried")
+	assert.Equal(t, "1", rec.Header().Get("lb-attempts"))
+}
+
+func TestPool_NoRetryWithBody(t *testing.T) {
+	good := newTestBackend(t, "good")
+	p := retryPool(t, deadAddr(t), good.addr())
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/", strings.NewReader("value")))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestPool_RetriesLimited(t *testing.T) {
+	enableTrace(t)
+	p := retryPool(t, deadAddr(t), deadAddr(t), deadAddr(t), deadAddr(t))
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "3", rec.Header().Get("lb-attempts"))
+
+	p.setRetries(0, defaultRetryBudget)
+	rec = httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "1", rec.Header().Get("lb-attempts"))
+}
+
+func TestPool_NoBudgetSpentWithoutBackend(t *testing.T) {
+	enableTrace(t)
+	other := newTestBackend(t, "other")
+	var p *pool
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Another request takes the probe of the only other backend.
+		b := p.breaker(other.addr())
+		b.mu.Lock()
+		b.open("test")
+		b.mu.Unlock()
+		b.acquire()
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+	p = retryPool(t, strings.TrimPrefix(unavailable.URL, "http://"), other.addr())
+	p.setBreaker(breakerConfig{failures: 5})
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("lb-attempts"))
+	assert.Equal(t, float64(retryBudgetBurst), p.budget.balance, "Budget was spent on a retry that did not happen")
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5)
+	for i := 0; i < retryBudgetBurst; i++ {
+		assert.True(t, b.retry(), "The burst ran out after %d retries", i)
+	}
+	assert.False(t, b.retry())
+
+	b.request()
+	assert.False(t, b.retry(), "Half a retry was spent")
+	b.request()
+	assert.True(t, b.retry())
+
+	for i := 0; i < 100; i++ {
+		b.request()
+	}
+	retries := 0
+	for b.retry() {
+		retries++
+	}
+	assert.Equal(t, retryBudgetBurst, retries, "Saved retries are not capped")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// defaultVirtualNodes is the number of points of a backend of weight 1 on
+// the hash ring.
+const defaultVirtualNodes = 100
+
+// ring is a consistent-hash ring. Every backend owns as many points on it
+// as its weight times the virtual nodes, and a key belongs to the backend of
+// the first point at or after the hash of the key. Adding or removing a
+// backend only moves the keys of its own points, about 1/N of them.
+type ring struct {
+	points []uint64
+	owners []string
+}
+
+// newRing places backends on a ring with vnodes points per unit of weight.
+func newRing(backends []backend, vnodes int) *ring {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	var points []point
+	for _, b := range backends {
+		for i := 0; i < b.Weight*vnodes; i++ {
+			points = append(points, point{ringHash(b.Addr + "#" + strconv.Itoa(i)), b.Addr})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	r := &ring{
+		points: make([]uint64, len(points)),
+		owners: make([]string, len(points)),
+	}
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// lookup returns the backend owning key, or false on an empty ring.
+func (r *ring) lookup(key string) (string, bool) {
+	return r.lookupAmong(key, nil)
+}
+
+// lookupAmong returns the backend owning key among the allowed ones,
+// walking clockwise past the points of the others, or false if none of them
+// is on the ring. That is the backend a ring of the allowed backends alone
+// would return. A nil allowed lets every backend through.
+func (r *ring) lookupAmong(key string, allowed map[string]bool) (string, bool) {
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	for n := 0; n < len(r.points); n++ {
+		owner := r.owners[(start+n)%len(r.points)]
+		if allowed == nil || allowed[owner] {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+func ringHash(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testServers = []backend{
+	{Addr: "server1:8080", Weight: 1},
+	{Addr: "server2:8080", Weight: 1},
+	{Addr: "server3:8080", Weight: 1},
+}
+
+func TestRing_ConsistentHashing(t *testing.T) {
+	addr := "192.168.1.100:12345"
+	server1, _ := newRing(testServers, 0).lookup(addr)
+	server2, _ := newRing(testServers, 0).lookup(addr)
+
+	assert.Equal(t, server1, server2, "Same address should map to the same server")
+}
+
+func TestRing_Distribution(t *testing.T) {
+	r := newRing(testServers, defaultVirtualNodes)
+	hits := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		server, _ := r.lookup(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		hits[server]++
+	}
+
+	for _, b := range testServers {
+		assert.InDelta(t, 1000, hits[b.Addr], 250, "Uneven distribution: %v", hits)
+	}
+}
+
+func TestRing_Weights(t *testing.T) {
+	backends := append([]backend{{Addr: "server4:8080", Weight: 3}}, testServers...)
+	r := newRing(backends, defaultVirtualNodes)
+	hits := make(map[string]int)
+	for i := 0; i < 6000; i++ {
+		server, _ := r.lookup(fmt.Sprintf("client-%d", i))
+		hits[server]++
+	}
+
+	// server4 has half of the weight.
+	assert.InDelta(t, 3000, hits["server4:8080"], 400, "Weights are not honoured: %v", hits)
+}
+
+func TestRing_NoServers(t *testing.T) {
+	_, ok := newRing(nil, defaultVirtualNodes).lookup("10.0.0.1:1234")
+	assert.False(t, ok)
+}
+
+// TestRing_RemovalRemapping checks that removing one of five backends moves
+// only its own clients, about a fifth of them, where hashing modulo the pool
+// size would move about four fifths.
+func TestRing_RemovalRemapping(t *testing.T) {
+	var backends []backend
+	for i := 1; i <= 5; i++ {
+		backends = append(backends, backend{Addr: fmt.Sprintf("server%d:8080", i), Weight: 1})
+	}
+	before := newRing(backends, defaultVirtualNodes)
+	after := newRing(backends[:4], defaultVirtualNodes)
+
+	const clients = 10000
+	moved := 0
+	for i := 0; i < clients; i++ {
+		key := fmt.Sprintf("10.1.%d.%d:1234", i/256, i%256)
+		was, _ := before.lookup(key)
+		now, _ := after.lookup(key)
+		if was == now {
+			continue
+		}
+		moved++
+		assert.Equal(t, "server5:8080", was, "A client of a remaining server moved")
+	}
+
+	share := float64(moved) / clients
+	t.Logf("%.1f%% of clients remapped", share*100)
+	assert.InDelta(t, 0.2, share, 0.05)
+}
+
+// TestRing_LookupAmong checks that walking past excluded backends picks
+// what a ring of the remaining ones would.
+func TestRing_LookupAmong(t *testing.T) {
+	full := newRing(testServers, defaultVirtualNodes)
+	reduced := newRing(testServers[:2], defaultVirtualNodes)
+	allowed := map[string]bool{testServers[0].Addr: true, testServers[1].Addr: true}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.2.%d.%d:1234", i/256, i%256)
+		expected, _ := reduced.lookup(key)
+		server, ok := full.lookupAmong(key, allowed)
+		assert.True(t, ok)
+		assert.Equal(t, expected, server, "Key %s", key)
+	}
+
+	_, ok := full.lookupAmong("10.0.0.1:1234", map[string]bool{"server9:8080": true})
+	assert.False(t, ok)
+}
+
+func TestClientHash_KeepsRingOnRetry(t *testing.T) {
+	s := newClientHash(defaultVirtualNodes, affinity{})
+	r := s.ringOf(testServers)
+	assert.Same(t, r, s.ringOf(testServers[1:]), "A reduced set rebuilt the ring")
+	assert.Same(t, r, s.ringOf(testServers), "The full set rebuilt the ring")
+
+	heavier := append([]backend{{Addr: testServers[0].Addr, Weight: 2}}, testServers[1:]...)
+	assert.NotSame(t, r, s.ringOf(heavier), "A weight change kept the ring")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the balancing strategies accepted by -strategy.
+const (
+	strategyRoundRobin         = "round-robin"
+	strategyWeightedRoundRobin = "weighted-round-robin"
+	strategyLeastConnections   = "least-connections"
+	strategyLeastResponseTime  = "least-response-time"
+	strategyTwoChoices         = "random-two-choices"
+	strategyClientHash         = "client-hash"
+)
+
+var strategyNames = []string{
+	strategyRoundRobin,
+	strategyWeightedRoundRobin,
+	strategyLeastConnections,
+	strategyLeastResponseTime,
+	strategyTwoChoices,
+	strategyClientHash,
+}
+
+// strategy picks the backend for a request.
+type strategy interface {
+	// choose returns one of backends, which are the healthy backends of the
+	// pool in its order and never empty.
+	choose(backends []backend, r *http.Request) backend
+}
+
+// newStrategy returns the strategy called name. The ones that balance by
+// load read it from load; the client hash keeps clients by aff on a ring
+// with vnodes points per unit of weight.
+func newStrategy(name string, load *loadStats, vnodes int, aff affinity) (strategy, error) {
+	switch name {
+	case strategyRoundRobin:
+		return new(roundRobin), nil
+	case strategyWeightedRoundRobin:
+		return newWeightedRoundRobin(), nil
+	case strategyLeastConnections:
+		return leastConnections{load}, nil
+	case strategyLeastResponseTime:
+		return leastResponseTime{load}, nil
+	case strategyTwoChoices:
+		return twoChoices{load}, nil
+	case strategyClientHash:
+		return newClientHash(vnodes, aff), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, expected one of %s", name, strings.Join(strategyNames, ", "))
+}
+
+// roundRobin takes the backends in turn, ignoring weights.
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobin) choose(backends []backend, _ *http.Request) backend {
+	n := s.next.Add(1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+// weightedRoundRobin is the smooth weighted round robin of nginx: each turn
+// every backend gains its weight, the one with the most is chosen and loses
+// the total. Heavier backends are chosen more often without long runs of
+// the same one.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(map[string]int)}
+}
+
+func (s *weightedRoundRobin) choose(backends []backend, _ *http.Request) backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total, best := 0, 0
+	for i, b := range backends {
+		s.current[b.Addr] += b.Weight
+		total += b.Weight
+		if s.current[b.Addr] > s.current[backends[best].Addr] {
+			best = i
+		}
+	}
+	s.current[backends[best].Addr] -= total
+	return backends[best]
+}
+
+// leastConnections chooses the backend with the fewest requests in flight
+// per unit of weight.
+type leastConnections struct {
+	load *loadStats
+}
+
+func (s leastConnections) choose(backends []backend, _ *http.Request) backend {
+	return pickLowest(backends, func(b backend) float64 {
+		return float64(s.load.inflight(b.Addr)) / float64(b.Weight)
+	})
+}
+
+// leastResponseTime chooses the backend with the lowest average response
+// time scaled by the requests in flight. Weights are not used: a backend
+// that can take more traffic shows it by answering faster. Backends without
+// a measurement yet come first.
+type leastResponseTime struct {
+	load *loadStats
+}
+
+func (s leastResponseTime) choose(backends []backend, _ *http.Request) backend {
+	return pickLowest(backends, func(b backend) float64 {
+		latency, inflight := s.load.get(b.Addr)
+		return latency.Seconds() * float64(inflight+1)
+	})
+}
+
+// twoChoices samples two backends at random and takes the one with fewer
+// requests in flight, which avoids both herding on one backend and keeping
+// track of all of them.
+type twoChoices struct {
+	load *loadStats
+}
+
+func (s twoChoices) choose(backends []backend, _ *http.Request) backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	return pickLowest([]backend{backends[i], backends[j]}, func(b backend) float64 {
+		return float64(s.load.inflight(b.Addr)) / float64(b.Weight)
+	})
+}
+
+// clientHash sends each client to the same backend through a
+// consistent-hash ring, so that a backend joining or leaving the healthy
+// set moves only the clients it takes or gave up. Clients are told apart by
+// their affinity key.
+type clientHash struct {
+	vnodes   int
+	affinity affinity
+
+	mu sync.Mutex
+	// weights holds the weight of every backend on ring.
+	weights map[string]int
+	ring    *ring
+}
+
+func newClientHash(vnodes int, aff affinity) *clientHash {
+	return &clientHash{vnodes: vnodes, affinity: aff}
+}
+
+func (s *clientHash) choose(backends []backend, r *http.Request) backend {
+	allowed := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		allowed[b.Addr] = true
+	}
+	server, _ := s.ringOf(backends).lookupAmong(s.affinity.key(r), allowed)
+	for _, b := range backends {
+		if b.Addr == server {
+			return b
+		}
+	}
+	return backends[0]
+}
+
+// ringOf returns a ring holding all of the backends. The ring is rebuilt
+// only when a backend is new to it or changed its weight, so retries and
+// backends leaving the healthy set walk past the missing ones on the ring
+// of the full set.
+func (s *clientHash) ringOf(backends []backend) *ring {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range backends {
+		if weight, ok := s.weights[b.Addr]; !ok || weight != b.Weight {
+			s.weights = make(map[string]int, len(backends))
+			for _, b := range backends {
+				s.weights[b.Addr] = b.Weight
+			}
+			s.ring = newRing(backends, s.vnodes)
+			break
+		}
+	}
+	return s.ring
+}
+
+// pickLowest returns the backend with the lowest score, breaking ties at
+// random so that idle backends share the traffic.
+func pickLowest(backends []backend, score func(backend) float64) backend {
+	var (
+		best    backend
+		lowest  float64
+		matches int
+	)
+	for i, b := range backends {
+		s := score(b)
+		switch {
+		case i == 0 || s < lowest:
+			best, lowest, matches = b, s, 1
+		case s == lowest:
+			matches++
+			if rand.IntN(matches) == 0 {
+				best = b
+			}
+		}
+	}
+	return best
+}
+
+// latencyDecay is the weight of the previous average in the moving average
+// of response times.
+const latencyDecay = 0.8
+
+// loadStats tracks the requests in flight and the moving average response
+// time of each backend.
+type loadStats struct {
+	mu      sync.Mutex
+	active  map[string]int
+	latency map[string]time.Duration
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		active:  make(map[string]int),
+		latency: make(map[string]time.Duration),
+	}
+}
+
+// begin counts a request to server as in flight until the returned function
+// is called, which also records the response time.
+func (l *loadStats) begin(server string) (end func()) {
+	start := time.Now()
+	l.start(server)
+	return func() {
+		l.finish(server, time.Since(start))
+	}
+}
+
+func (l *loadStats) start(server string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[server]++
+}
+
+// finish ends a request to server that took elapsed.
+func (l *loadStats) finish(server string, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[server]--
+	if l.active[server] == 0 {
+		delete(l.active, server)
+	}
+	if last, ok := l.latency[server]; ok {
+		elapsed = time.Duration(latencyDecay*float64(last) + (1-latencyDecay)*float64(elapsed))
+	}
+	l.latency[server] = elapsed
+}
+
+// inflight returns the number of requests to server in flight.
+func (l *loadStats) inflight(server string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active[server]
+}
+
+// get returns the average response time of server and its requests in
+// flight.
+func (l *loadStats) get(server string) (time.Duration, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latency[server], l.active[server]
+}
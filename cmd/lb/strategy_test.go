@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var strategyBackends = []backend{
+	{Addr: "a:8080", Weight: 1},
+	{Addr: "b:8080", Weight: 1},
+	{Addr: "c:8080", Weight: 2},
+}
+
+// spread sends n requests from different clients through s, each taking
+// 10ms and finishing before the next starts, and counts the choices.
+func spread(s strategy, load *loadStats, backends []backend, n int) map[string]int {
+	hits := make(map[string]int)
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		server := s.choose(backends, req).Addr
+		load.start(server)
+		load.finish(server, 10*time.Millisecond)
+		hits[server]++
+	}
+	return hits
+}
+
+func TestNewStrategy_Unknown(t *testing.T) {
+	_, err := newStrategy("fastest", newLoadStats(), defaultVirtualNodes, affinity{})
+	assert.Error(t, err)
+}
+
+func TestStrategies_Distribution(t *testing.T) {
+	for _, name := range strategyNames {
+		t.Run(name, func(t *testing.T) {
+			load := newLoadStats()
+			s, err := newStrategy(name, load, defaultVirtualNodes, affinity{})
+			require.NoError(t, err)
+			hits := spread(s, load, strategyBackends, 400)
+
+			switch name {
+			case strategyRoundRobin:
+				assert.Equal(t, map[string]int{"a:8080": 134, "b:8080": 133, "c:8080": 133}, hits)
+			case strategyWeightedRoundRobin:
+				assert.Equal(t, map[string]int{"a:8080": 100, "b:8080": 100, "c:8080": 200}, hits)
+			default:
+				for _, b := range strategyBackends {
+					assert.Greater(t, hits[b.Addr], 40, "%s is starved: %v", b.Addr, hits)
+				}
+			}
+		})
+	}
+}
+
+func TestStrategies_FailedBackend(t *testing.T) {
+	for _, name := range strategyNames {
+		t.Run(name, func(t *testing.T) {
+			load := newLoadStats()
+			s, err := newStrategy(name, load, defaultVirtualNodes, affinity{})
+			require.NoError(t, err)
+			spread(s, load, strategyBackends, 100)
+
+			healthy := []backend{strategyBackends[0], strategyBackends[2]}
+			hits := spread(s, load, healthy, 100)
+			assert.Zero(t, hits["b:8080"])
+			assert.Greater(t, hits["a:8080"], 0)
+			assert.Greater(t, hits["c:8080"], 0)
+
+			assert.Equal(t, map[string]int{"c:8080": 100}, spread(s, load, strategyBackends[2:], 100))
+		})
+	}
+}
+
+func TestStrategies_NoHealthyBackends(t *testing.T) {
+	for _, name := range strategyNames {
+		t.Run(name, func(t *testing.T) {
+			p := newPool(strategyBackends)
+			require.NoError(t, p.setStrategy(name, defaultVirtualNodes, affinity{}))
+			rec := httptest.NewRecorder()
+			p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		})
+	}
+}
+
+func TestLeastConnections_AvoidsBusyBackend(t *testing.T) {
+	load := newLoadStats()
+	s, _ := newStrategy(strategyLeastConnections, load, defaultVirtualNodes, affinity{})
+	load.start("a:8080")
+	load.start("c:8080")
+
+	// c has one request per two units of weight, b none.
+	hits := spread(s, load, strategyBackends, 10)
+	assert.Equal(t, map[string]int{"b:8080": 10}, hits)
+}
+
+func TestLeastResponseTime_PrefersFastBackend(t *testing.T) {
+	load := newLoadStats()
+	s, _ := newStrategy(strategyLeastResponseTime, load, defaultVirtualNodes, affinity{})
+	load.latency["a:8080"] = 100 * time.Millisecond
+	load.latency["b:8080"] = 10 * time.Millisecond
+	load.latency["c:8080"] = 50 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "b:8080", s.choose(strategyBackends, req).Addr)
+
+	// Requests in flight make b slower than c.
+	for i := 0; i < 5; i++ {
+		load.start("b:8080")
+	}
+	assert.Equal(t, "c:8080", s.choose(strategyBackends, req).Addr)
+}
+
+func TestTwoChoices_AvoidsBusiestBackend(t *testing.T) {
+	load := newLoadStats()
+	s, _ := newStrategy(strategyTwoChoices, load, defaultVirtualNodes, affinity{})
+	for i := 0; i < 10; i++ {
+		load.start("a:8080")
+	}
+
+	hits := spread(s, load, strategyBackends, 300)
+	assert.Zero(t, hits["a:8080"])
+}
+
+func TestClientHash_SameClientSameBackend(t *testing.T) {
+	s, _ := newStrategy(strategyClientHash, newLoadStats(), defaultVirtualNodes, affinity{})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.100:12345"
+	first := s.choose(strategyBackends, req)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, s.choose(strategyBackends, req))
+	}
+}
+
+func TestLoadStats_MovingAverage(t *testing.T) {
+	load := newLoadStats()
+	load.latency["a:8080"] = 100 * time.Millisecond
+	load.start("a:8080")
+	load.finish("a:8080", 0)
+	latency, inflight := load.get("a:8080")
+	assert.Zero(t, inflight)
+	assert.Equal(t, 80*time.Millisecond, latency)
+}
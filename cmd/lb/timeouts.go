@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timeouts limit how long a backend may take to answer. Zero means no
+// limit, or for a route, the limit of the balancer.
+type timeouts struct {
+	// Connect limits the opening of a connection to the backend.
+	Connect duration `yaml:"connect_timeout" json:"connect_timeout"`
+	// ResponseHeader limits the wait for the response head once the request
+	// is sent.
+	ResponseHeader duration `yaml:"response_header_timeout" json:"response_header_timeout"`
+	// Total limits the whole exchange, body included.
+	Total duration `yaml:"timeout" json:"timeout"`
+}
+
+// merge returns t with the limits set in override replaced.
+func (t timeouts) merge(override timeouts) timeouts {
+	if override.Connect != 0 {
+		t.Connect = override.Connect
+	}
+	if override.ResponseHeader != 0 {
+		t.ResponseHeader = override.ResponseHeader
+	}
+	if override.Total != 0 {
+		t.Total = override.Total
+	}
+	return t
+}
+
+// route overrides the timeouts of the requests whose path starts with
+// Prefix.
+type route struct {
+	Prefix   string `yaml:"prefix" json:"prefix"`
+	timeouts `yaml:",inline"`
+}
+
+// defaultTimeouts are the limits of the balancer, set from the flags.
+var defaultTimeouts timeouts
+
+// flagTimeouts reads the timeout flags; it is called after flag.Parse.
+func flagTimeouts() timeouts {
+	return timeouts{
+		Connect:        duration(*connectTimeout),
+		ResponseHeader: duration(*responseHeaderTimeout),
+		Total:          duration(time.Duration(*timeoutSec) * time.Second),
+	}
+}
+
+// parseRouteTimeouts parses the -route-timeouts flag: comma-separated
+// prefix=timeout pairs overriding the total timeout.
+func parseRouteTimeouts(list string) ([]route, error) {
+	var res []route
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("route timeout %q is not prefix=timeout", item)
+		}
+		total, err := time.ParseDuration(limit)
+		if err != nil {
+			return nil, fmt.Errorf("bad timeout of %s: %w", prefix, err)
+		}
+		res = append(res, route{Prefix: prefix, timeouts: timeouts{Total: duration(total)}})
+	}
+	return normalizeRoutes(res)
+}
+
+// normalizeRoutes rejects unusable routes.
+func normalizeRoutes(routes []route) ([]route, error) {
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("route prefix %q does not start with /", r.Prefix)
+		}
+		if r.Connect < 0 || r.ResponseHeader < 0 || r.Total < 0 {
+			return nil, fmt.Errorf("route %s has a negative timeout", r.Prefix)
+		}
+	}
+	return routes, nil
+}
+
+// setRoutes replaces the per-route timeouts.
+func (p *pool) setRoutes(routes []route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routes = routes
+}
+
+// timeoutsFor returns the timeouts of a request to path: the ones of the
+// route with the longest matching prefix over the defaults. Of routes with
+// the same prefix, the last one wins.
+func (p *pool) timeoutsFor(path string) timeouts {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var best *route
+	for i := range p.routes {
+		r := &p.routes[i]
+		if strings.HasPrefix(path, r.Prefix) && (best == nil || len(r.Prefix) >= len(best.Prefix)) {
+			best = r
+		}
+	}
+	if best == nil {
+		return defaultTimeouts
+	}
+	return defaultTimeouts.merge(best.timeouts)
+}
+
+// Causes of the cancellation of a request to a backend.
+var (
+	errResponseHeaderTimeout = errors.New("response header timeout")
+	errTotalTimeout          = errors.New("timeout")
+)
+
+// timeoutError tells that a backend did not answer in time.
+type timeoutError struct {
+	stage string
+	limit time.Duration
+	err   error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s exceeded: %s", e.stage, e.limit, e.err)
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+// withTimeouts returns the context of a request to a backend limited by t.
+// The total limit only applies if total is set, as switched protocols are
+// not limited. Once the response head arrives, the caller calls gotHead to
+// lift the response header limit; cancel releases the context.
+func withTimeouts(parent context.Context, t timeouts, total bool) (ctx context.Context, gotHead func() bool, cancel func()) {
+	cancelTotal := func() {}
+	ctx = context.WithValue(parent, connectTimeoutKey{}, time.Duration(t.Connect))
+	if total && t.Total > 0 {
+		ctx, cancelTotal = context.WithTimeoutCause(ctx, time.Duration(t.Total), errTotalTimeout)
+	}
+	ctx, cancelHead := context.WithCancelCause(ctx)
+	gotHead = func() bool { return true }
+	if t.ResponseHeader > 0 {
+		timer := time.AfterFunc(time.Duration(t.ResponseHeader), func() {
+			cancelHead(errResponseHeaderTimeout)
+		})
+		gotHead = timer.Stop
+	}
+	return ctx, gotHead, func() {
+		cancelHead(nil)
+		cancelTotal()
+	}
+}
+
+// timeoutOf returns err as a timeoutError if a limit of t ran out.
+func timeoutOf(ctx context.Context, t timeouts, err error) error {
+	var netErr net.Error
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errResponseHeaderTimeout):
+		return &timeoutError{"response header", time.Duration(t.ResponseHeader), err}
+	case errors.Is(cause, errTotalTimeout):
+		return &timeoutError{"total", time.Duration(t.Total), err}
+	case errors.As(err, &netErr) && netErr.Timeout() && isDialError(err):
+		return &timeoutError{"connect", time.Duration(t.Connect), err}
+	}
+	return err
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// connectTimeoutKey is the context key of the connect timeout of a request.
+type connectTimeoutKey struct{}
+
+// newTransport returns the transport to the backends, which takes the
+// connect timeout of each request from its context.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if limit, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && limit > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, limit)
+			defer cancel()
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return t
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setDefaultTimeouts(t *testing.T, limits timeouts) {
+	old := defaultTimeouts
+	defaultTimeouts = limits
+	t.Cleanup(func() {
+		defaultTimeouts = old
+	})
+}
+
+func TestFlagTimeouts(t *testing.T) {
+	old := *timeoutSec
+	t.Cleanup(func() {
+		*timeoutSec = old
+	})
+	*timeoutSec = 7
+	assert.Equal(t, duration(7*time.Second), flagTimeouts().Total, "The flag is read when called, not at start")
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	routes, err := parseRouteTimeouts("/api/v1/some-data=30s, /slow=1m,")
+	require.NoError(t, err)
+	assert.Equal(t, []route{
+		{Prefix: "/api/v1/some-data", timeouts: timeouts{Total: duration(30 * time.Second)}},
+		{Prefix: "/slow", timeouts: timeouts{Total: duration(time.Minute)}},
+	}, routes)
+
+	for _, list := range []string{"/api", "/api=soon", "api=1s", "/api=-1s"} {
+		_, err := parseRouteTimeouts(list)
+		assert.Error(t, err, list)
+	}
+}
+
+func TestLoadConfig_Routes(t *testing.T) {
+	dir := t.TempDir()
+	expected := []route{{Prefix: "/api/v1/some-data", timeouts: timeouts{
+		Connect:        duration(time.Second),
+		ResponseHeader: duration(20 * time.Second),
+		Total:          duration(30 * time.Second),
+	}}}
+
+	yamlPath := filepath.Join(dir, "pool.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte(`
+backends:
+  - addr: a:8080
+routes:
+  - prefix: /api/v1/some-data
+    connect_timeout: 1s
+    response_header_timeout: 20s
+    timeout: 30s
+`), 0o600))
+	conf, err := loadConfig(yamlPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, conf.Routes)
+
+	jsonPath := filepath.Join(dir, "pool.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{
+		"backends": [{"addr": "a:8080"}],
+		"routes": [{"prefix": "/api/v1/some-data", "connect_timeout": "1s",
+			"response_header_timeout": "20s", "timeout": "30s"}]
+	}`), 0o600))
+	conf, err = loadConfig(jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, conf.Routes)
+}
+
+func TestPool_TimeoutsFor(t *testing.T) {
+	setDefaultTimeouts(t, timeouts{Connect: duration(time.Second), Total: duration(3 * time.Second)})
+	p := newPool(nil)
+	p.setRoutes([]route{
+		{Prefix: "/api/", timeouts: timeouts{Total: duration(10 * time.Second)}},
+		{Prefix: "/api/v1/some-data", timeouts: timeouts{ResponseHeader: duration(20 * time.Second), Total: duration(30 * time.Second)}},
+		{Prefix: "/api/", timeouts: timeouts{Total: duration(5 * time.Second)}},
+	})
+
+	assert.Equal(t, defaultTimeouts, p.timeoutsFor("/health"))
+	assert.Equal(t, timeouts{Connect: duration(time.Second), Total: duration(5 * time.Second)}, p.timeoutsFor("/api/v2"))
+	assert.Equal(t, timeouts{
+		Connect:        duration(time.Second),
+		ResponseHeader: duration(20 * time.Second),
+		Total:          duration(30 * time.Second),
+	}, p.timeoutsFor("/api/v1/some-data"))
+}
+
+func TestPool_GatewayTimeout(t *testing.T) {
+	setDefaultTimeouts(t, timeouts{Total: duration(50 * time.Millisecond)})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/streaming" {
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(backend.Close)
+	p := retryPool(t, backend.Listener.Addr().String())
+	p.setRoutes([]route{
+		{Prefix: "/slow", timeouts: timeouts{Total: duration(time.Second)}},
+		{Prefix: "/streaming", timeouts: timeouts{ResponseHeader: duration(50 * time.Millisecond), Total: duration(time.Second)}},
+		{Prefix: "/slow/head", timeouts: timeouts{ResponseHeader: duration(50 * time.Millisecond)}},
+	})
+	handler := p.handler()
+
+	for path, expected := range map[string]int{
+		"/":          http.StatusGatewayTimeout,
+		"/slow":      http.StatusOK,
+		"/streaming": http.StatusOK,
+		"/slow/head": http.StatusGatewayTimeout,
+	} {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		assert.Equal(t, expected, rec.Code, path)
+		if expected == http.StatusGatewayTimeout {
+			assert.Less(t, time.Since(start), 150*time.Millisecond, "%s answered late", path)
+		}
+	}
+}
+
+func TestPool_GatewayTimeoutNotRetried(t *testing.T) {
+	enableTrace(t)
+	setDefaultTimeouts(t, timeouts{Total: duration(100 * time.Millisecond)})
+	slow := func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}
+	b1 := httptest.NewServer(http.HandlerFunc(slow))
+	t.Cleanup(b1.Close)
+	b2 := httptest.NewServer(http.HandlerFunc(slow))
+	t.Cleanup(b2.Close)
+	p := retryPool(t, b1.Listener.Addr().String(), b2.Listener.Addr().String())
+	require.Greater(t, p.retries, 0)
+	frontend := httptest.NewServer(p.handler())
+	t.Cleanup(frontend.Close)
+
+	start := time.Now()
+	resp, err := http.Get(frontend.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("lb-attempts"))
+	assert.Less(t, time.Since(start), 200*time.Millisecond, "The retries ran past the total limit")
+}
+
+func TestRetryable_Timeouts(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("i/o timeout")}
+	assert.True(t, retryable(req, nil, &timeoutError{"connect", time.Second, dialErr}))
+	assert.False(t, retryable(req, nil, &timeoutError{"response header", time.Second, errResponseHeaderTimeout}))
+	assert.False(t, retryable(req, nil, &timeoutError{"total", time.Second, errTotalTimeout}))
+}
+
+func TestWithTimeouts(t *testing.T) {
+	limits := timeouts{ResponseHeader: duration(20 * time.Millisecond), Total: duration(time.Minute)}
+
+	ctx, gotHead, cancel := withTimeouts(context.Background(), limits, true)
+	assert.True(t, gotHead())
+	time.Sleep(40 * time.Millisecond)
+	assert.NoError(t, ctx.Err(), "The header limit applied after the head arrived")
+	cancel()
+	assert.Error(t, ctx.Err(), "cancel left the context running")
+
+	ctx, gotHead, cancel = withTimeouts(context.Background(), limits, true)
+	defer cancel()
+	<-ctx.Done()
+	assert.False(t, gotHead())
+	var timeoutErr *timeoutError
+	err := timeoutOf(ctx, limits, ctx.Err())
+	require.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "response header", timeoutErr.stage)
+
+	ctx, _, cancel = withTimeouts(context.Background(), timeouts{Total: duration(time.Millisecond)}, false)
+	defer cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, ctx.Err(), "A switched protocol was given a total limit")
+}
+
+func TestTransport_ConnectTimeout(t *testing.T) {
+	ctx := context.WithValue(context.Background(), connectTimeoutKey{}, 50*time.Millisecond)
+	start := time.Now()
+	// A non-routable address, where connecting hangs.
+	conn, err := newTransport().DialContext(ctx, "tcp", "10.255.255.1:80")
+	if err == nil {
+		conn.Close()
+		t.Skip("The network accepted a connection to a non-routable address")
+	}
+	if err := timeoutOf(ctx, timeouts{Connect: duration(50 * time.Millisecond)}, err); !isTimeout(err) {
+		t.Skipf("The network refused the connection at once: %v", err)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr *timeoutError
+	return errors.As(err, &timeoutErr) && timeoutErr.stage == "connect"
+}
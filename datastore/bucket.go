@@ -0,0 +1,232 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Records of named buckets share the log with the default bucket. Their key
+// field holds the bucket name as well:
+//
+//	(NUL) (bucket) (NUL) (key)
+//
+// which is why keys of the default bucket cannot start with a NUL byte.
+const bucketMark = "\x00"
+
+func bucketKey(bucket, key string) string {
+	return bucketMark + bucket + bucketMark + key
+}
+
+func isBucketKey(key string) bool {
+	return strings.HasPrefix(key, bucketMark)
+}
+
+// splitBucketKey returns the bucket name and the key of an internal key.
+// Keys of the default bucket have an empty bucket name.
+func splitBucketKey(key string) (bucket, name string) {
+	if !isBucketKey(key) {
+		return "", key
+	}
+	bucket, name, _ = strings.Cut(key[len(bucketMark):], bucketMark)
+	return bucket, name
+}
+
+func checkDefaultKey(key string) error {
+	if isBucketKey(key) {
+		return errors.New("keys cannot start with a NUL byte")
+	}
+	return nil
+}
+
+func checkBucketName(name string) error {
+	if name == "" || len(name) > 255 || strings.Contains(name, bucketMark) {
+		return fmt.Errorf("bad bucket name %q", name)
+	}
+	return nil
+}
+
+// Bucket is a handle to the keys of one named bucket. Keys of different
+// buckets never clash.
+type Bucket struct {
+	db   *Db
+	name string
+	err  error
+}
+
+// Bucket returns a handle to the named bucket. Buckets need not be created:
+// one exists as long as it holds keys.
+func (db *Db) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name, err: checkBucketName(name)}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	return b.db.get(ctx, bucketKey(b.name, key))
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+func (b *Bucket) PutContext(ctx context.Context, key, value string) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.put(ctx, bucketKey(b.name, key), value, false)
+}
+
+func (b *Bucket) TryPut(key, value string) error {
+	return b.TryPutContext(context.Background(), key, value)
+}
+
+func (b *Bucket) TryPutContext(ctx context.Context, key, value string) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.put(ctx, bucketKey(b.name, key), value, true)
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+func (b *Bucket) DeleteContext(ctx context.Context, key string) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.delete(ctx, bucketKey(b.name, key), false)
+}
+
+func (b *Bucket) TryDelete(key string) error {
+	return b.TryDeleteContext(context.Background(), key)
+}
+
+func (b *Bucket) TryDeleteContext(ctx context.Context, key string) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.delete(ctx, bucketKey(b.name, key), true)
+}
+
+func (b *Bucket) PutStream(key string, r io.Reader, size int64) error {
+	return b.PutStreamContext(context.Background(), key, r, size)
+}
+
+func (b *Bucket) PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.putStream(ctx, bucketKey(b.name, key), r, size, false)
+}
+
+func (b *Bucket) TryPutStream(key string, r io.Reader, size int64) error {
+	return b.TryPutStreamContext(context.Background(), key, r, size)
+}
+
+func (b *Bucket) TryPutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.db.putStream(ctx, bucketKey(b.name, key), r, size, true)
+}
+
+func (b *Bucket) GetStream(key string) (io.ReadCloser, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.db.getStream(bucketKey(b.name, key))
+}
+
+// Keys returns the live keys of the bucket in ascending order.
+func (b *Bucket) Keys() ([]string, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	prefix := bucketKey(b.name, "")
+	var keys []string
+	for _, key := range b.db.keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key[len(prefix):])
+		}
+	}
+	return keys, nil
+}
+
+// Iterate calls fn for every key of the bucket in ascending key order.
+func (b *Bucket) Iterate(fn func(key, value string) error) error {
+	keys, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := b.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buckets returns the names of the buckets holding live keys.
+func (db *Db) Buckets() []string {
+	var names []string
+	for _, key := range db.keys() {
+		bucket, _ := splitBucketKey(key)
+		// Keys are sorted, so the keys of one bucket are next to each other.
+		if bucket != "" && (len(names) == 0 || names[len(names)-1] != bucket) {
+			names = append(names, bucket)
+		}
+	}
+	return names
+}
+
+// DeleteBucket removes every key of the bucket in one atomic write.
+func (db *Db) DeleteBucket(ctx context.Context, name string) error {
+	return db.deleteBucket(ctx, name, false)
+}
+
+// TryDeleteBucket is DeleteBucket that fails with ErrBusy rather than wait
+// for room in a full write queue.
+func (db *Db) TryDeleteBucket(ctx context.Context, name string) error {
+	return db.deleteBucket(ctx, name, true)
+}
+
+func (db *Db) deleteBucket(ctx context.Context, name string, try bool) error {
+	// A full queue refuses the deletion before the keys are collected.
+	if try && !db.readOnly && len(db.writeCh) == cap(db.writeCh) {
+		db.metrics.rejected()
+		return ErrBusy
+	}
+	b := db.Bucket(name)
+	keys, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	tombstones := make([]entry, len(keys))
+	for i, key := range keys {
+		tombstones[i] = newTombstone(bucketKey(name, key))
+	}
+	return db.submit(writeRequest{ctx: ctx, records: tombstones, batch: true, try: try})
+}
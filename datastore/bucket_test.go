@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	teams, users := db.Bucket("teams"), db.Bucket("users")
+	db.Put("k", "default")
+	teams.Put("k", "team")
+	teams.Put("k2", "team2")
+	users.Put("k", "user")
+
+	for _, tc := range []struct {
+		get      func(string) (string, error)
+		expected string
+	}{
+		{db.Get, "default"},
+		{teams.Get, "team"},
+		{users.Get, "user"},
+	} {
+		if val, err := tc.get("k"); err != nil || val != tc.expected {
+			t.Errorf("Get(k) = %q, %v, wanted %q", val, err, tc.expected)
+		}
+	}
+
+	var defaultKeys []string
+	db.Iterate(func(key, _ string) error {
+		defaultKeys = append(defaultKeys, key)
+		return nil
+	})
+	if !reflect.DeepEqual(defaultKeys, []string{"k"}) {
+		t.Errorf("Default bucket iteration returned %v", defaultKeys)
+	}
+	if keys, _ := teams.Keys(); !reflect.DeepEqual(keys, []string{"k", "k2"}) {
+		t.Errorf("teams holds %v", keys)
+	}
+	if names := db.Buckets(); !reflect.DeepEqual(names, []string{"teams", "users"}) {
+		t.Errorf("Buckets() = %v", names)
+	}
+
+	if err := db.DeleteBucket(context.Background(), "teams"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := teams.Get("k"); err != ErrNotFound {
+		t.Errorf("Key of a deleted bucket is still there: %v", err)
+	}
+	if val, err := users.Get("k"); err != nil || val != "user" {
+		t.Errorf("Deleting a bucket touched another one: %q, %v", val, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := db.Buckets(); !reflect.DeepEqual(names, []string{"users"}) {
+		t.Errorf("Buckets() after reopening = %v", names)
+	}
+	if val, err := db.Bucket("users").Get("k"); err != nil || val != "user" {
+		t.Errorf("Bucket value after reopening = %q, %v", val, err)
+	}
+}
+
+func TestBuckets_BadNames(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Bucket("").Put("k", "v"); err == nil {
+		t.Error("Bucket with an empty name accepted a write")
+	}
+	if err := db.Bucket("a\x00b").Put("k", "v"); err == nil {
+		t.Error("Bucket with a NUL in the name accepted a write")
+	}
+	if err := db.Put("\x00teams\x00k", "v"); err == nil {
+		t.Error("Default bucket accepted a key that looks like a bucket key")
+	}
+}
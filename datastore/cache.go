@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats describes the state of the value cache.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+type cacheItem struct {
+	key, value string
+}
+
+func (it *cacheItem) size() int64 {
+	return int64(len(it.key) + len(it.value))
+}
+
+// valueCache is a byte-bounded LRU cache of values. A nil *valueCache is a
+// valid disabled cache.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+
+	// version grows on every invalidation, so a reader that loaded a value
+	// from disk can tell whether it became stale while it was reading.
+	version uint64
+
+	hits, misses uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheItem).value, true
+}
+
+func (c *valueCache) currentVersion() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// addIfUnchanged caches the value unless the cache was invalidated after
+// the version was taken.
+func (c *valueCache) addIfUnchanged(key, value string, version uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != version {
+		return
+	}
+
+	item := &cacheItem{key: key, value: value}
+	if item.size() > c.capacity {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	c.items[key] = c.order.PushFront(item)
+	c.size += item.size()
+
+	for c.size > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	item := c.order.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= item.size()
+}
+
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: len(c.items),
+		Bytes:   c.size,
+	}
+}
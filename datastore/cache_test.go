@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestValueCache_Eviction(t *testing.T) {
+	c := newValueCache(8)
+
+	c.addIfUnchanged("a", "11", c.currentVersion())
+	c.addIfUnchanged("b", "22", c.currentVersion())
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+
+	// "a" was used last, so "b" is the one to go.
+	c.addIfUnchanged("c", "33", c.currentVersion())
+	if _, ok := c.get("b"); ok {
+		t.Error("b should be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("a should survive eviction")
+	}
+	if stats := c.stats(); stats.Bytes > 8 {
+		t.Errorf("Cache holds %d bytes, capacity is 8", stats.Bytes)
+	}
+
+	c.addIfUnchanged("big", "too large to fit", c.currentVersion())
+	if _, ok := c.get("big"); ok {
+		t.Error("Values larger than the capacity must not be cached")
+	}
+}
+
+func TestValueCache_StaleAdd(t *testing.T) {
+	c := newValueCache(1024)
+	version := c.currentVersion()
+	c.remove("k")
+	c.addIfUnchanged("k", "old", version)
+	if _, ok := c.get("k"); ok {
+		t.Error("Value read before invalidation must not be cached")
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{MaxSize: 10, CacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if val, err := db.Get("k1"); err != nil || val != "v1" {
+			t.Fatalf("Get(k1) = %q, %v", val, err)
+		}
+	}
+	if stats := db.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Unexpected cache stats after reads: %+v", stats)
+	}
+
+	if err := db.Put("k1", "v1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("k1"); err != nil || val != "v1.1" {
+		t.Errorf("Get(k1) after Put = %q, %v", val, err)
+	}
+
+	db.Put("k2", "v2")
+	db.Put("k3", "v3")
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.CacheStats(); stats.Entries != 0 {
+		t.Errorf("Cache should be empty after merge, got %d entries", stats.Entries)
+	}
+	if val, err := db.Get("k1"); err != nil || val != "v1.1" {
+		t.Errorf("Get(k1) after merge = %q, %v", val, err)
+	}
+}
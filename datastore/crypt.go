@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrNoKey = errors.New("record is encrypted with an unknown key")
+
+// Keyring holds the AES keys used to encrypt record values. New records are
+// sealed with the current key; the other keys are kept to read older data
+// until a merge re-encrypts it.
+//
+// Sealed values are stored as
+//
+//	(id length) (key id) (nonce) (AES-GCM ciphertext)
+//	1           ....     12      .....
+//
+// with the record key as additional data, so a value cannot be moved under
+// another key unnoticed. Keys themselves stay in cleartext.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from AES keys of 16, 24 or 32 bytes.
+func NewKeyring(currentID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the keyring", currentID)
+	}
+	k := &Keyring{current: currentID, aeads: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("bad key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring reads keys written as "id:hex-key", separated by commas or
+// new lines. The first key is the current one. Empty lines and lines
+// starting with # are skipped.
+func ParseKeyring(spec string) (*Keyring, error) {
+	var current string
+	keys := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(spec, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, hexKey, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("key %q must look like id:hex-key", line)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("key %q is defined twice", id)
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+	if current == "" {
+		return nil, errors.New("no encryption keys given")
+	}
+	return NewKeyring(current, keys)
+}
+
+// EncryptionKeysEnv names the environment variable LoadKeyring reads keys
+// from when no key file is given, in the format of ParseKeyring.
+const EncryptionKeysEnv = "DB_ENCRYPTION_KEYS"
+
+// LoadKeyring parses the keys in keyFile or, if keyFile is empty, in the
+// EncryptionKeysEnv variable. It returns a nil keyring if there are none.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	spec := os.Getenv(EncryptionKeysEnv)
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(content)
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	return ParseKeyring(spec)
+}
+
+// CurrentID returns the id of the key new records are sealed with.
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// seal encrypts the value of e with the current key. A nil keyring leaves
+// records as they are.
+func (k *Keyring) seal(e entry) (entry, error) {
+	if k == nil || e.deleted() {
+		return e, nil
+	}
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return entry{}, err
+	}
+
+	payload := make([]byte, 0, 1+len(k.current)+len(nonce)+len(e.value)+aead.Overhead())
+	payload = append(payload, byte(len(k.current)))
+	payload = append(payload, k.current...)
+	payload = append(payload, nonce...)
+	payload = aead.Seal(payload, nonce, []byte(e.value), []byte(e.key))
+
+	sealed := newEntry(e.key, string(payload))
+	sealed.flags = e.flags | flagEncrypted
+	return sealed, nil
+}
+
+// open returns e with its value decrypted.
+func (k *Keyring) open(e entry) (entry, error) {
+	if !e.encrypted() {
+		return e, nil
+	}
+	id, nonce, ciphertext, err := splitSealed(e.value)
+	if err != nil {
+		return entry{}, fmt.Errorf("key '%s': %w", e.key, err)
+	}
+	if k == nil || k.aeads[id] == nil {
+		return entry{}, fmt.Errorf("key '%s' (key id %q): %w", e.key, id, ErrNoKey)
+	}
+	aead := k.aeads[id]
+	if len(nonce) != aead.NonceSize() {
+		return entry{}, fmt.Errorf("key '%s': bad nonce", e.key)
+	}
+	value, err := aead.Open(nil, []byte(nonce), []byte(ciphertext), []byte(e.key))
+	if err != nil {
+		return entry{}, fmt.Errorf("cannot decrypt key '%s': %w", e.key, err)
+	}
+
+	opened := newEntry(e.key, string(value))
+	opened.flags = e.flags &^ flagEncrypted
+	return opened, nil
+}
+
+// needsReseal tells whether a merge has to re-encrypt the record.
+func (k *Keyring) needsReseal(e entry) bool {
+	if k == nil || e.deleted() {
+		return false
+	}
+	if !e.encrypted() {
+		return true
+	}
+	id, _, _, err := splitSealed(e.value)
+	return err != nil || id != k.current
+}
+
+func splitSealed(payload string) (id, nonce, ciphertext string, err error) {
+	const nonceSize = 12
+	if len(payload) < 1 {
+		return "", "", "", errors.New("empty sealed value")
+	}
+	idLen := int(payload[0])
+	if len(payload) < 1+idLen+nonceSize {
+		return "", "", "", errors.New("sealed value is truncated")
+	}
+	id = payload[1 : 1+idLen]
+	nonce = payload[1+idLen : 1+idLen+nonceSize]
+	return id, nonce, payload[1+idLen+nonceSize:], nil
+}
@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "a:000102030405060708090a0b0c0d0e0f"
+	testKeyB = "b:101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+)
+
+func mustKeyring(t *testing.T, spec string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestParseKeyring(t *testing.T) {
+	k := mustKeyring(t, "# rotated on Monday\n"+testKeyB+"\n"+testKeyA+"\n")
+	if k.CurrentID() != "b" {
+		t.Errorf("Current key is %q, wanted b", k.CurrentID())
+	}
+
+	for _, spec := range []string{"", "a", "a:zz", "a:0011", testKeyA + "," + testKeyA} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	t.Setenv(EncryptionKeysEnv, testKeyA)
+	k, err := LoadKeyring("")
+	if err != nil || k.CurrentID() != "a" {
+		t.Fatalf("LoadKeyring from the environment: %v, %v", k, err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte(testKeyB+"\n"+testKeyA+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err = LoadKeyring(keyFile)
+	if err != nil || k.CurrentID() != "b" {
+		t.Errorf("The key file did not win over the environment: %v, %v", k, err)
+	}
+
+	t.Setenv(EncryptionKeysEnv, "")
+	if k, err := LoadKeyring(""); k != nil || err != nil {
+		t.Errorf("LoadKeyring without keys returned %v, %v", k, err)
+	}
+}
+
+// dirContains tells whether any file in dir holds the text.
+func dirContains(t *testing.T, dir, text string) bool {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(content, []byte(text)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDb_Encryption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{MaxSize: 100, Keyring: mustKeyring(t, testKeyA)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("k1", "secret-one")
+	db.Put("k2", "secret-two")
+	if val, err := db.Get("k1"); err != nil || val != "secret-one" {
+		t.Fatalf("Get(k1) = %q, %v", val, err)
+	}
+	if dirContains(t, tmp, "secret-") {
+		t.Error("Values are stored in cleartext")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		db, err := Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("k1"); !errors.Is(err, ErrNoKey) {
+			t.Errorf("Get without a keyring returned %v, wanted ErrNoKey", err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		db, err := OpenWithOptions(tmp, Options{MaxSize: 100, Keyring: mustKeyring(t, testKeyB+","+testKeyA)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		db.Put("k3", "secret-three")
+		db.Put("k4", "secret-four")
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+
+		for key, expected := range map[string]string{"k1": "secret-one", "k2": "secret-two", "k3": "secret-three"} {
+			if val, err := db.Get(key); err != nil || val != expected {
+				t.Errorf("Get(%s) = %q, %v", key, val, err)
+			}
+		}
+
+		f, err := os.Open(db.segments[0].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		in := bufio.NewReader(f)
+		for {
+			var record entry
+			if _, err := record.DecodeFromReader(in); err != nil {
+				break
+			}
+			id, _, _, err := splitSealed(record.value)
+			if !record.encrypted() || err != nil || id != "b" {
+				t.Errorf("Record %s is not sealed with the current key after merge", record.key)
+			}
+		}
+	})
+}
+
+func TestKeyring_BoundToKey(t *testing.T) {
+	k := mustKeyring(t, testKeyA)
+	sealed, err := k.seal(newEntry("k1", "value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := newEntry("k2", sealed.value)
+	moved.flags = sealed.flags
+	if _, err := k.open(moved); err == nil || !strings.Contains(err.Error(), "decrypt") {
+		t.Errorf("Value moved to another key was decrypted: %v", err)
+	}
+}
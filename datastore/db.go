@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,7 +11,6 @@ import (
 	"sort"
 	"sync"
 	"time"
-	"crypto/sha1"
 )
 
 const (
@@ -19,197 +19,739 @@ const (
 	defaultMaxSize = 10 * 1024 * 1024 // 10MB
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrClosed   = errors.New("datastore is closed")
+	// ErrBusy is returned by TryPut, TryDelete, TryPutStream and
+	// TryDeleteBucket when the write queue is full.
+	ErrBusy = errors.New("write queue is full")
+)
+
+const defaultQueueSize = 100
 
-type hashIndex map[string]int64
+// recordPos locates the latest record of a key inside a file.
+type recordPos struct {
+	offset  int64
+	size    int64
+	deleted bool
+}
+
+type hashIndex map[string]recordPos
 
 type writeRequest struct {
-	key   string
-	value string
-	done  chan error
+	ctx     context.Context
+	records []entry
+	// batch asks for the records to be stored atomically.
+	batch bool
+	// reads are the key versions a transaction saw; the write fails with
+	// ErrConflict if any of them has changed.
+	reads map[string]uint64
+	// stream is a value spooled by PutStream, written instead of records.
+	stream *spooledValue
+	// try makes the request fail with ErrBusy instead of waiting for room
+	// in the queue.
+	try    bool
+	queued time.Time
+	done   chan error
 }
 
 type Db struct {
-	out       *os.File
-	outOffset int64
-	outPath   string
+	out        *os.File
+	outOffset  int64
+	outPath    string
+	outCreated time.Time
 	dir       string
 	index     hashIndex
 	segments  []*Segment
 	maxSize   int64
 
+	// versions holds the sequence number of the last write of every key
+	// written since Open. Transactions use it to detect conflicts.
+	versions map[string]uint64
+	seq      uint64
+
 	writeCh chan writeRequest
 	wg      sync.WaitGroup
 	rwMu    sync.RWMutex 
 
+	cache   *valueCache
+	metrics dbMetrics
+	keyring *Keyring
 
-	closeOnce sync.Once
+	idxMu      sync.RWMutex
+	indexes    map[string]*secondaryIndex
+	indexSpecs []IndexSpec
+
+	readOnly bool
+	// lock keeps other writers out of dir; read-only databases have none.
+	lock *dirLock
+
+
+	// closeMu guards closed and keeps writeCh open while writes are
+	// being queued.
+	closeMu sync.RWMutex
+	closed  bool
 }
 
 type Segment struct {
-	path  string
-	index hashIndex
+	path    string
+	index   hashIndex
+	size    int64
+	created time.Time
+}
+
+// Options configures a Db opened with OpenWithOptions.
+type Options struct {
+	// MaxSize is the size of the active file after which it is rotated
+	// into a segment. Zero means defaultMaxSize.
+	MaxSize int64
+	// CacheSize is the number of bytes of keys and values kept in the LRU
+	// value cache. Zero disables the cache.
+	CacheSize int64
+	// Keyring enables encryption of values. Nil stores them in cleartext.
+	Keyring *Keyring
+	// Indexes are secondary indexes kept up to date by the write loop.
+	Indexes []IndexSpec
+	// ReadOnly opens the directory without writing to it; see OpenReadOnly.
+	ReadOnly bool
+	// QueueSize is the number of writes that may wait for the write loop.
+	// Put blocks and TryPut fails with ErrBusy while it is full. Zero means
+	// defaultQueueSize.
+	QueueSize int
 }
 
 func Open(dir string) (*Db, error) {
-	return OpenWithMaxSize(dir, defaultMaxSize)
+	return OpenWithOptions(dir, Options{})
 }
 
 func OpenWithMaxSize(dir string, maxSize int64) (*Db, error) {
-	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		return nil, err
+	return OpenWithOptions(dir, Options{MaxSize: maxSize})
+}
+
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
 	}
 
 	db := &Db{
-		out:     f,
-		outPath: outputPath,
-		dir:     dir,
-		index:   make(hashIndex),
-		maxSize: maxSize,
-		writeCh: make(chan writeRequest, 100),
+		outPath:    filepath.Join(dir, outFileName),
+		dir:        dir,
+		index:      make(hashIndex),
+		maxSize:    maxSize,
+		versions:   make(map[string]uint64),
+		cache:      newValueCache(opts.CacheSize),
+		keyring:    opts.Keyring,
+		readOnly:   opts.ReadOnly,
+		indexSpecs: opts.Indexes,
+	}
+
+	if !db.readOnly {
+		lock, err := lockDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		db.lock = lock
 	}
-
-	if err := db.recover(); err != nil && err != io.EOF {
+	if err := db.load(queueSize); err != nil {
+		db.lock.release()
 		return nil, err
 	}
+	return db, nil
+}
+
+// load reads the data files of a new Db and starts its write loop.
+func (db *Db) load(queueSize int) error {
+	if !db.readOnly {
+		// Leftovers of PutStream calls and migrations that never completed.
+		for _, prefix := range []string{spoolPrefix, migratePrefix} {
+			leftovers, _ := filepath.Glob(filepath.Join(db.dir, prefix+"*"))
+			for _, path := range leftovers {
+				os.Remove(path)
+			}
+		}
+		if _, err := os.Stat(db.outPath); errors.Is(err, os.ErrNotExist) {
+			f, err := createDataFile(db.outPath)
+			if err != nil {
+				return err
+			}
+			f.Close()
+		}
+	}
+
+	if err := db.recover(); err != nil {
+		return err
+	}
 	if err := db.loadSegments(); err != nil {
-		return nil, err
+		return err
+	}
+	if err := db.buildIndexes(db.indexSpecs); err != nil {
+		return err
+	}
+	if db.readOnly {
+		return nil
 	}
 
+	f, err := os.OpenFile(db.outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	db.out = f
+	db.writeCh = make(chan writeRequest, queueSize)
 	db.wg.Add(1)
 	go db.writeLoop()
 
-	return db, nil
+	return nil
 }
 
 func (db *Db) writeLoop() {
 	defer db.wg.Done()
 	for req := range db.writeCh {
-		err := db.putInternal(req.key, req.value)
-		req.done <- err
+		db.metrics.queueWait.observe(time.Since(req.queued))
+		// Requests whose context expired while queued are dropped.
+		if err := req.ctx.Err(); err != nil {
+			req.done <- err
+			continue
+		}
+		req.done <- db.apply(req)
 	}
 }
 
-func (db *Db) putInternal(key, value string) error {
-	hash := sha1.Sum([]byte(value))
+func (db *Db) apply(req writeRequest) error {
+	if err := db.checkVersions(req.reads); err != nil {
+		return err
+	}
+	if req.stream != nil {
+		return db.writeStream(req.stream)
+	}
+	if req.batch {
+		return db.writeRecords(req.records, true)
+	}
+	for _, e := range req.records {
+		if err := db.writeRecords([]entry{e}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	e := entry{
-		key:   key,
-		value: value,
-		checksum: hash,
+func (db *Db) checkVersions(reads map[string]uint64) error {
+	db.rwMu.RLock()
+	defer db.rwMu.RUnlock()
+	for key, version := range reads {
+		if db.versions[key] != version {
+			return ErrConflict
+		}
 	}
-	data := e.Encode()
+	return nil
+}
+
+// writeRecords appends the records to the active file with a single write.
+// A batch is flagged and closed with a commit marker, so that recovery
+// either sees all of its records or none; it is never split between files.
+func (db *Db) writeRecords(records []entry, batch bool) error {
+	var data []byte
+	positions := make([]recordPos, len(records))
+	for i, e := range records {
+		if batch {
+			e.flags |= flagBatch
+		}
+		encoded := e.Encode()
+		positions[i] = recordPos{offset: int64(len(data)), size: int64(len(encoded)), deleted: e.deleted()}
+		data = append(data, encoded...)
+	}
+	if batch {
+		marker := newCommitMarker()
+		data = append(data, marker.Encode()...)
+	}
+
+	if err := db.makeRoom(int64(len(data))); err != nil {
+		return err
+	}
+	n, err := db.out.Write(data)
+	if err != nil {
+		return db.discardTail(err)
+	}
+	return db.written(records, positions, int64(n))
+}
 
+// makeRoom rotates the active file if n more bytes would take it past
+// maxSize. A file without records is never rotated, so a record larger than maxSize
+// gets a file of its own.
+func (db *Db) makeRoom(n int64) error {
 	size, err := db.Size()
 	if err != nil {
 		return err
 	}
-
-	if size+int64(len(data)) > db.maxSize {
-		if err := db.rotateFile(); err != nil {
-			return err
-		}
+	if size > headerSize && size+n > db.maxSize {
+		return db.rotateFile()
 	}
+	return nil
+}
 
-	n, err := db.out.Write(data)
-	if err == nil {
-		db.rwMu.Lock()
-		db.index[key] = db.outOffset
-		db.outOffset += int64(n)
-		db.rwMu.Unlock()
+// discardTail cuts a partly written record off the active file, so that
+// later records do not end up behind it.
+func (db *Db) discardTail(err error) error {
+	if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+		return fmt.Errorf("%w (cannot truncate the data file: %v)", err, truncErr)
 	}
 	return err
 }
 
+// written publishes records just appended to the active file. positions
+// are relative to the start of the write, which took n bytes.
+func (db *Db) written(records []entry, positions []recordPos, n int64) error {
+	db.rwMu.Lock()
+	for i, e := range records {
+		position := positions[i]
+		position.offset += db.outOffset
+		db.index[e.key] = position
+		db.seq++
+		db.versions[e.key] = db.seq
+	}
+	db.outOffset += n
+	db.rwMu.Unlock()
+
+	for _, e := range records {
+		db.cache.remove(e.key)
+	}
+	// The records are stored already, so an index that cannot take one
+	// does not fail the write; it is counted in Stats.
+	for _, e := range records {
+		if err := db.updateIndexes(e); err != nil {
+			db.metrics.indexFailed()
+		}
+	}
+	return nil
+}
+
 func (db *Db) Put(key, value string) error {
-	done := make(chan error)
-	db.writeCh <- writeRequest{key: key, value: value, done: done}
-	return <-done
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put that gives up once ctx is done. A write that was
+// already being applied when ctx expired may still land.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.put(ctx, key, value, false)
+}
+
+// TryPut is Put that fails with ErrBusy rather than wait for room in a full
+// write queue.
+func (db *Db) TryPut(key, value string) error {
+	return db.TryPutContext(context.Background(), key, value)
+}
+
+func (db *Db) TryPutContext(ctx context.Context, key, value string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.put(ctx, key, value, true)
+}
+
+// put writes a value under an internal key, which may be bucket-scoped.
+func (db *Db) put(ctx context.Context, key, value string, try bool) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	e, err := db.keyring.seal(newEntry(key, value))
+	if err != nil {
+		return err
+	}
+	return db.submit(writeRequest{ctx: ctx, records: []entry{e}, try: try})
+}
+
+// Delete removes the key by appending a tombstone record. Deleting a
+// missing key is not an error.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.delete(ctx, key, false)
+}
+
+// TryDelete is Delete that fails with ErrBusy rather than wait for room in a
+// full write queue.
+func (db *Db) TryDelete(key string) error {
+	return db.TryDeleteContext(context.Background(), key)
+}
+
+func (db *Db) TryDeleteContext(ctx context.Context, key string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.delete(ctx, key, true)
+}
+
+func (db *Db) delete(ctx context.Context, key string, try bool) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.submit(writeRequest{ctx: ctx, records: []entry{newTombstone(key)}, try: try})
+}
+
+// write queues the records for the write loop, which stores them one after
+// another with no other write in between.
+func (db *Db) write(ctx context.Context, records ...entry) error {
+	return db.submit(writeRequest{ctx: ctx, records: records})
+}
+
+// submit hands the request to the write loop and waits for the outcome.
+func (db *Db) submit(req writeRequest) error {
+	ctx := req.ctx
+	start := time.Now()
+	defer func() {
+		db.metrics.put.observe(time.Since(start))
+	}()
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// The write loop may answer after the caller has gone, so done is
+	// buffered.
+	done := make(chan error, 1)
+	req.done = done
+	req.queued = time.Now()
+
+	db.closeMu.RLock()
+	if db.closed {
+		db.closeMu.RUnlock()
+		return ErrClosed
+	}
+	if req.try {
+		select {
+		case db.writeCh <- req:
+			db.closeMu.RUnlock()
+		default:
+			db.closeMu.RUnlock()
+			db.metrics.rejected()
+			return ErrBusy
+		}
+	} else {
+		select {
+		case db.writeCh <- req:
+			db.closeMu.RUnlock()
+		case <-ctx.Done():
+			db.closeMu.RUnlock()
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Db) isClosed() bool {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	return db.closed
 }
 
 func (db *Db) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return "", err
+	}
+	return db.get(ctx, key)
+}
+
+func (db *Db) get(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if db.isClosed() {
+		return "", ErrClosed
+	}
+
+	start := time.Now()
+	defer func() {
+		db.metrics.get.observe(time.Since(start))
+	}()
+
+	if value, ok := db.cache.get(key); ok {
+		return value, nil
+	}
+
+	// The version must be taken before the index is consulted: a Put that
+	// lands in between bumps it and keeps a stale value out of the cache.
+	version := db.cache.currentVersion()
+	value, err := db.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	db.cache.addIfUnchanged(key, value, version)
+	return value, nil
+}
+
+// CacheStats reports hit and miss counters of the value cache.
+func (db *Db) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+func (db *Db) lookup(key string) (string, error) {
+	file, position, err := db.openRecord(key)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return db.readRecord(file, key, position)
+}
+
+// openRecord opens the file holding the latest record of the key. The file
+// is opened under the lock, so it stays readable even if a rotation or a
+// merge renames or removes it right after.
+func (db *Db) openRecord(key string) (*os.File, recordPos, error) {
 	db.rwMu.RLock()
+	defer db.rwMu.RUnlock()
+
+	path := db.outPath
 	position, ok := db.index[key]
-	db.rwMu.RUnlock()
+	for i := len(db.segments) - 1; !ok && i >= 0; i-- {
+		path = db.segments[i].path
+		position, ok = db.segments[i].index[key]
+	}
+	if !ok || position.deleted {
+		return nil, recordPos{}, ErrNotFound
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, recordPos{}, err
+	}
+	return file, position, nil
+}
 
-	if ok {
-		value, err := db.readFromFile(db.outPath, position)
-		if err == nil {
-			return value, nil
+// Iterate calls fn for every live key outside of named buckets in
+// ascending key order. Values are read one by one, so writes made during
+// the iteration may be observed.
+func (db *Db) Iterate(fn func(key, value string) error) error {
+	for _, key := range db.keys() {
+		if isBucketKey(key) {
+			continue
+		}
+		value, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	for i := len(db.segments) - 1; i >= 0; i-- {
-		seg := db.segments[i]
-		if position, ok := seg.index[key]; ok {
-			return db.readFromFile(seg.path, position)
+// keys returns the sorted list of keys that are not deleted.
+func (db *Db) keys() []string {
+	var keys []string
+	db.walkLive(func(key string, _ recordPos, _ int) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// walkLive calls fn for the latest record of every live key. file is the
+// position of the record's file in db.segments, or len(db.segments) for
+// the active file.
+func (db *Db) walkLive(fn func(key string, position recordPos, file int)) {
+	db.rwMu.RLock()
+	defer db.rwMu.RUnlock()
+	db.walkLiveLocked(fn)
+}
+
+func (db *Db) walkLiveLocked(fn func(key string, position recordPos, file int)) {
+	seen := make(map[string]struct{})
+	visit := func(index hashIndex, file int) {
+		for key, position := range index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if !position.deleted {
+				fn(key, position, file)
+			}
 		}
 	}
+	visit(db.index, len(db.segments))
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		visit(db.segments[i].index, i)
+	}
+}
+
+func (db *Db) Stats() (Stats, error) {
+	if db.isClosed() {
+		return Stats{}, ErrClosed
+	}
+	var stats Stats
+
+	db.rwMu.RLock()
+	for _, seg := range db.segments {
+		stats.Files = append(stats.Files, SegmentStats{Name: filepath.Base(seg.path), TotalBytes: seg.size, Created: seg.created})
+	}
+	stats.Files = append(stats.Files, SegmentStats{Name: outFileName, TotalBytes: db.outOffset, Created: db.outCreated})
+	stats.Segments = len(db.segments)
+	db.walkLiveLocked(func(_ string, position recordPos, file int) {
+		stats.Keys++
+		stats.Files[file].LiveBytes += position.size
+	})
+	db.rwMu.RUnlock()
 
-	return "", ErrNotFound
+	for _, file := range stats.Files {
+		stats.Bytes += file.TotalBytes
+	}
+	stats.QueueDepth = len(db.writeCh)
+	stats.QueueCapacity = cap(db.writeCh)
+	stats.Cache = db.cache.stats()
+	db.metrics.fill(&stats)
+	return stats, nil
 }
 
 
+// Close waits for queued writes and closes the files. Any call made after
+// Close returns ErrClosed.
 func (db *Db) Close() error {
-	var err error
-	db.closeOnce.Do(func() {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return nil
+	}
+	db.closed = true
+	if db.writeCh != nil {
 		close(db.writeCh)
-		db.wg.Wait()
+	}
+	db.closeMu.Unlock()
+
+	db.wg.Wait()
+	var err error
+	if db.out != nil {
 		err = db.out.Close()
-	})
+	}
+	if lockErr := db.lock.release(); err == nil {
+		err = lockErr
+	}
 	return err
 }
 
-func (db *Db) readFromFile(path string, position int64) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
+func (db *Db) readRecord(file *os.File, key string, position recordPos) (string, error) {
+	var record entry
+	in := bufio.NewReader(io.NewSectionReader(file, position.offset, position.size))
+	if _, err := record.DecodeFromReader(in); err != nil {
 		return "", err
 	}
-	defer file.Close()
-
-	_, err = file.Seek(position, 0)
-	if err != nil {
-		return "", err
+	if record.key != key {
+		return "", ErrStale
 	}
 
-	var record entry
-	if _, err = record.DecodeFromReader(bufio.NewReader(file)); err != nil {
+	if err := record.verify(); err != nil {
+		db.metrics.checksumFailed()
 		return "", err
 	}
 
-	calculated := sha1.Sum([]byte(record.value))
-	if record.checksum != calculated {
-		return "", fmt.Errorf("data checksum mismatch for key '%s'", record.key)
+	record, err := db.keyring.open(record)
+	if err != nil {
+		return "", err
 	}
-
 	return record.value, nil
 }
 
 
 func (db *Db) recover() error {
-	f, err := os.Open(db.outPath)
+	index, header, size, err := db.readDataFile(db.outPath)
+	if db.readOnly && errors.Is(err, os.ErrNotExist) {
+		// The writer has not started yet.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	db.index, db.outCreated, db.outOffset = index, header.created, size
+	return nil
+}
+
+// readDataFile indexes the committed records of a data file and returns its
+// header and size.
+func (db *Db) readDataFile(path string) (hashIndex, fileHeader, int64, error) {
+	header, start, err := readFileHeader(path, !db.readOnly)
+	if err != nil {
+		return nil, header, 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, header, 0, err
+	}
+	defer file.Close()
+
+	in := bufio.NewReader(file)
+	if _, err := in.Discard(int(start)); err != nil {
+		return nil, header, 0, err
+	}
+	index := make(hashIndex)
+	size, err := readLog(in, start, func(record entry, position recordPos) {
+		index[record.key] = position
+	})
+	if db.readOnly && errors.Is(err, io.ErrUnexpectedEOF) {
+		// The writer is in the middle of appending a record.
+		err = nil
+	}
+	return index, header, size, err
+}
 
-	in := bufio.NewReader(f)
+// readLog calls fn for every committed record of a data file and returns
+// the length of the file. Only keys and flags of the records are read.
+// Records of a batch are passed on only when the commit marker of the batch
+// is reached; a batch cut short by a crash is skipped.
+func readLog(in *bufio.Reader, start int64, fn func(record entry, position recordPos)) (int64, error) {
+	type pendingRecord struct {
+		record   entry
+		position recordPos
+	}
+	offset := start
+	var pending []pendingRecord
 	for {
 		var record entry
-		n, err := record.DecodeFromReader(in)
+		n, err := record.decodeKeyFromReader(in)
 		if errors.Is(err, io.EOF) {
-			break
+			return offset, nil
 		}
 		if err != nil {
-			return err
+			return offset, err
 		}
+		position := recordPos{offset: offset, size: int64(n), deleted: record.deleted()}
+		offset += int64(n)
 
-		db.index[record.key] = db.outOffset
-		db.outOffset += int64(n)
+		switch {
+		case record.flags&flagCommit != 0:
+			for _, p := range pending {
+				fn(p.record, p.position)
+			}
+			pending = pending[:0]
+		case record.flags&flagBatch != 0:
+			pending = append(pending, pendingRecord{record, position})
+		default:
+			pending = pending[:0]
+			fn(record, position)
+		}
 	}
-	return nil
 }
 
 func (db *Db) Size() (int64, error) {
@@ -220,7 +762,13 @@ func (db *Db) Size() (int64, error) {
 	return info.Size(), nil
 }
 
+// rotateFile turns the active file into a segment. Readers are locked out
+// for the whole swap, so none of them opens the new file with positions of
+// the old one.
 func (db *Db) rotateFile() error {
+	db.rwMu.Lock()
+	defer db.rwMu.Unlock()
+
 	if err := db.out.Close(); err != nil {
 		return err
 	}
@@ -230,39 +778,31 @@ func (db *Db) rotateFile() error {
 		return err
 	}
 
-	seg, err := db.loadSegment(segmentPath)
-	if err != nil {
-		return err
-	}
-	db.segments = append(db.segments, seg)
-
-	f, err := os.OpenFile(db.outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	f, err := createDataFile(db.outPath)
 	if err != nil {
 		return err
 	}
 
+	// The index of the active file is the index of the new segment.
+	db.segments = append(db.segments, &Segment{
+		path:    segmentPath,
+		index:   db.index,
+		size:    db.outOffset,
+		created: db.outCreated,
+	})
 	db.out = f
-	db.outOffset = 0
+	db.outOffset = headerSize
+	db.outCreated = time.Now()
 	db.index = make(hashIndex)
 	return nil
 }
 
 func (db *Db) loadSegments() error {
-	files, err := os.ReadDir(db.dir)
+	segmentFiles, err := db.listSegments()
 	if err != nil {
 		return err
 	}
 
-	var segmentFiles []string
-	for _, file := range files {
-		name := file.Name()
-		if name != outFileName && len(name) > len(segmentPrefix) && name[:len(segmentPrefix)] == segmentPrefix {
-			segmentFiles = append(segmentFiles, name)
-		}
-	}
-
-	sort.Strings(segmentFiles)
-
 	for _, segFile := range segmentFiles {
 		segPath := filepath.Join(db.dir, segFile)
 		seg, err := db.loadSegment(segPath)
@@ -275,55 +815,77 @@ func (db *Db) loadSegments() error {
 	return nil
 }
 
-func (db *Db) loadSegment(path string) (*Segment, error) {
-	file, err := os.Open(path)
+// listSegments returns the names of the segment files, oldest first.
+func (db *Db) listSegments() ([]string, error) {
+	files, err := os.ReadDir(db.dir)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	seg := &Segment{
-		path:  path,
-		index: make(hashIndex),
+	var segmentFiles []string
+	for _, file := range files {
+		name := file.Name()
+		if name != outFileName && len(name) > len(segmentPrefix) && name[:len(segmentPrefix)] == segmentPrefix {
+			segmentFiles = append(segmentFiles, name)
+		}
 	}
 
-	in := bufio.NewReader(file)
-	var offset int64
-	for {
-		var record entry
-		n, err := record.DecodeFromReader(in)
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+	sort.Strings(segmentFiles)
+	return segmentFiles, nil
+}
 
-		seg.index[record.key] = offset
-		offset += int64(n)
+func (db *Db) loadSegment(path string) (*Segment, error) {
+	index, header, size, err := db.readDataFile(path)
+	if err != nil {
+		return nil, err
 	}
+	return &Segment{path: path, index: index, size: size, created: header.created}, nil
+}
 
-	return seg, nil
+// reseal moves a record under the current encryption key.
+func (db *Db) reseal(record entry) (entry, error) {
+	if err := record.verify(); err != nil {
+		db.metrics.checksumFailed()
+		return entry{}, err
+	}
+	opened, err := db.keyring.open(record)
+	if err != nil {
+		return entry{}, err
+	}
+	return db.keyring.seal(opened)
 }
 
+// MergeSegments compacts all segments into one. With a keyring configured
+// the values are re-encrypted under its current key on the way.
 func (db *Db) MergeSegments() error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	db.rwMu.Lock()
 	defer db.rwMu.Unlock()
 
 	if len(db.segments) < 2 {
 		return nil
 	}
+	start := time.Now()
 
 	tempPath := filepath.Join(db.dir, "merged-temp")
-	tempFile, err := os.OpenFile(tempPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	tempFile, err := createDataFile(tempPath)
 	if err != nil {
 		return err
 	}
 
 	mergedIndex := make(hashIndex)
-	var offset int64
+	offset := int64(headerSize)
 
-	for _, seg := range db.segments {
+	// Newer segments win, and inside a segment only the record its index
+	// points to is live. Tombstones are dropped: the merged segment is the
+	// oldest one, so there is nothing left for them to hide.
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
 		file, err := os.Open(seg.path)
 		if err != nil {
 			tempFile.Close()
@@ -332,9 +894,16 @@ func (db *Db) MergeSegments() error {
 		}
 
 		reader := bufio.NewReader(file)
+		if err := skipHeader(reader); err != nil {
+			file.Close()
+			tempFile.Close()
+			os.Remove(tempPath)
+			return err
+		}
+		recordOffset := int64(headerSize)
 		for {
 			var record entry
-			_, err := record.DecodeFromReader(reader)
+			n, err := record.DecodeFromReader(reader)
 			if errors.Is(err, io.EOF) {
 				break
 			}
@@ -344,19 +913,41 @@ func (db *Db) MergeSegments() error {
 				os.Remove(tempPath)
 				return err
 			}
+			position, indexed := seg.index[record.key]
+			live := indexed && position.offset == recordOffset && record.flags&flagCommit == 0
+			recordOffset += int64(n)
 
-			if _, exists := mergedIndex[record.key]; !exists {
-				data := record.Encode()
-				written, err := tempFile.Write(data)
+			if _, exists := mergedIndex[record.key]; !live || exists {
+				continue
+			}
+			// Only committed batch records are indexed, and the merged
+			// segment holds no commit markers.
+			record.flags &^= flagBatch
+			if record.deleted() {
+				// Remembered so that older records of the key stay dead.
+				mergedIndex[record.key] = recordPos{deleted: true}
+				continue
+			}
+			if db.keyring.needsReseal(record) {
+				record, err = db.reseal(record)
 				if err != nil {
 					file.Close()
 					tempFile.Close()
 					os.Remove(tempPath)
 					return err
 				}
-				mergedIndex[record.key] = offset
-				offset += int64(written)
 			}
+
+			data := record.Encode()
+			written, err := tempFile.Write(data)
+			if err != nil {
+				file.Close()
+				tempFile.Close()
+				os.Remove(tempPath)
+				return err
+			}
+			mergedIndex[record.key] = recordPos{offset: offset, size: int64(written)}
+			offset += int64(written)
 		}
 		file.Close()
 	}
@@ -384,5 +975,7 @@ func (db *Db) MergeSegments() error {
 	}
 
 	db.segments = []*Segment{newSeg}
+	db.cache.purge()
+	db.metrics.mergeDone(time.Since(start))
 	return nil
 }
@@ -1,90 +1,15 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestDb(t *testing.T) {
-	tmp := t.TempDir()
-	db, err := Open(tmp)
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Cleanup(func() {
-		_ = db.Close()
-	})
-
-	pairs := [][]string{
-		{"k1", "v1"},
-		{"k2", "v2"},
-		{"k3", "v3"},
-		{"k2", "v2.1"},
-	}
-
-	t.Run("put/get", func(t *testing.T) {
-		for _, pair := range pairs {
-			err := db.Put(pair[0], pair[1])
-			if err != nil {
-				t.Errorf("Cannot put %s: %s", pair[0], err)
-			}
-			value, err := db.Get(pair[0])
-			if err != nil {
-				t.Errorf("Cannot get %s: %s", pair[0], err)
-			}
-			if value != pair[1] {
-				t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
-			}
-		}
-	})
-
-	t.Run("file growth", func(t *testing.T) {
-		sizeBefore, err := db.Size()
-		if err != nil {
-			t.Fatal(err)
-		}
-		for _, pair := range pairs {
-			err := db.Put(pair[0], pair[1])
-			if err != nil {
-				t.Errorf("Cannot put %s: %s", pair[0], err)
-			}
-		}
-		sizeAfter, err := db.Size()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if sizeAfter <= sizeBefore {
-			t.Errorf("Size does not grow after put (before %d, after %d)", sizeBefore, sizeAfter)
-		}
-	})
-
-	t.Run("new db process", func(t *testing.T) {
-		if err := db.Close(); err != nil {
-			t.Fatal(err)
-		}
-		db, err = Open(tmp)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		uniquePairs := make(map[string]string)
-		for _, pair := range pairs {
-			uniquePairs[pair[0]] = pair[1]
-		}
-
-		for key, expectedValue := range uniquePairs {
-			value, err := db.Get(key)
-			if err != nil {
-				t.Errorf("Cannot get %s: %s", key, err)
-			}
-			if value != expectedValue {
-				t.Errorf("Get(%q) = %q, wanted %q", key, value, expectedValue)
-			}
-		}
-	})
-}
-
 func TestSegmentRotation(t *testing.T) {
 	tmp := t.TempDir()
 	db, err := OpenWithMaxSize(tmp, 10) // Small size for testing
@@ -204,6 +129,33 @@ func TestSegmentMerge(t *testing.T) {
 	}
 }
 
+func TestSegmentMerge_NewestValueWins(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSize(tmp, 10) // Every record gets its own segment
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	// Both values of k1 end up in segments, the newer one in a later one.
+	db.Put("k1", "v1")
+	db.Put("k1", "v2")
+	db.Put("k2", "v3")
+	db.Put("k3", "v4")
+	if len(db.segments) < 3 {
+		t.Fatalf("Expected at least 3 segments, got %d", len(db.segments))
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get("k1"); err != nil || val != "v2" {
+		t.Errorf("Get(k1) after merge = %q, %v; wanted v2", val, err)
+	}
+}
+
 func TestMergeAtomicity(t *testing.T) {
     tmp := t.TempDir()
     
@@ -310,3 +262,151 @@ func TestCorruptedChecksumEntry(t *testing.T) {
 	}
 	t.Logf("Successfully detected checksum mismatch: %v", err)
 }
+
+func TestDeleteSurvivesMerge(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSize(tmp, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	db.Put("k1", "v1")
+	db.Put("k2", "v2")
+	if err := db.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("k3", "v3")
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("k1"); err != ErrNotFound {
+		t.Errorf("Deleted key is back after merge: %v", err)
+	}
+	if val, err := db.Get("k2"); err != nil || val != "v2" {
+		t.Errorf("Get(k2) after merge = %q, %v", val, err)
+	}
+}
+
+func TestDb_Stats(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	db.Put("k1", "v1")
+	db.Put("k2", "v2")
+	db.Put("k1", "v1.1")
+	db.Get("k1")
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 {
+		t.Errorf("Expected 2 keys, got %d", stats.Keys)
+	}
+	var live, total int64
+	for _, file := range stats.Files {
+		live += file.LiveBytes
+		total += file.TotalBytes
+	}
+	if total != stats.Bytes || live >= total {
+		t.Errorf("Unexpected byte counters: live %d, total %d, stats %+v", live, total, stats)
+	}
+	if stats.PutLatency.Count != 3 || stats.GetLatency.Count != 1 {
+		t.Errorf("Unexpected latency counters: put %d, get %d", stats.PutLatency.Count, stats.GetLatency.Count)
+	}
+
+	db.Put("k3", "v3")
+	db.Put("k4", "v4")
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := db.Stats(); stats.Merges != 1 {
+		t.Errorf("Expected 1 merge, got %d", stats.Merges)
+	}
+}
+
+func TestDb_QueuedWriteCancelled(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	db.writeCh <- writeRequest{ctx: ctx, records: []entry{newEntry("k", "v")}, done: done}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled request returned %v", err)
+	}
+	if _, err := db.Get("k"); err != ErrNotFound {
+		t.Errorf("Cancelled request was written: %v", err)
+	}
+}
+
+func TestDb_TryPut(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{QueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Bucket("team").Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The write loop stalls on the lock with one write taken and the next
+	// one filling the queue.
+	db.rwMu.Lock()
+	errs := make(chan error, 2)
+	for _, key := range []string{"a", "b"} {
+		go func(key string) {
+			errs <- db.Put(key, "v")
+		}(key)
+	}
+	for len(db.writeCh) < cap(db.writeCh) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.TryPut("c", "v"); !errors.Is(err, ErrBusy) {
+		t.Errorf("TryPut with a full queue returned %v", err)
+	}
+	if err := db.TryDelete("a"); !errors.Is(err, ErrBusy) {
+		t.Errorf("TryDelete with a full queue returned %v", err)
+	}
+	if err := db.TryPutStream("c", strings.NewReader("v"), 1); !errors.Is(err, ErrBusy) {
+		t.Errorf("TryPutStream with a full queue returned %v", err)
+	}
+	if err := db.TryDeleteBucket(context.Background(), "team"); !errors.Is(err, ErrBusy) {
+		t.Errorf("TryDeleteBucket with a full queue returned %v", err)
+	}
+	db.rwMu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.TryPut("c", "v"); err != nil {
+		t.Errorf("TryPut with an empty queue returned %v", err)
+	}
+
+	stats, _ := db.Stats()
+	if stats.Rejected != 4 || stats.QueueCapacity != 1 || stats.QueueWait.Count != 4 {
+		t.Errorf("Rejected = %d, QueueCapacity = %d, QueueWait.Count = %d",
+			stats.Rejected, stats.QueueCapacity, stats.QueueWait.Count)
+	}
+}
@@ -6,24 +6,82 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	//"crypto/sha1"
+	"crypto/sha1"
 )
 
 type entry struct {
 	key, value string
+	flags      byte
 	checksum   [20]byte
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+const (
+	// flagTombstone marks a deleted key.
+	flagTombstone byte = 1 << iota
+	// flagEncrypted marks a value sealed by a Keyring.
+	flagEncrypted
+	// flagBatch marks a record written by a transaction. Such records only
+	// count once the commit marker of their batch follows them.
+	flagBatch
+	// flagCommit marks the record closing a batch. It has no key or value.
+	flagCommit
+)
+
+// Record flags share the key length field with the length itself, so keys
+// are limited to maxKeyLen bytes.
+const (
+	flagsShift = 24
+	maxKeyLen  = 1<<flagsShift - 1
+)
+
+func newEntry(key, value string) entry {
+	return entry{key: key, value: value, checksum: sha1.Sum([]byte(value))}
+}
+
+func newTombstone(key string) entry {
+	e := newEntry(key, "")
+	e.flags = flagTombstone
+	return e
+}
+
+func newCommitMarker() entry {
+	e := newEntry("", "")
+	e.flags = flagCommit
+	return e
+}
+
+func (e *entry) deleted() bool {
+	return e.flags&flagTombstone != 0
+}
+
+func (e *entry) encrypted() bool {
+	return e.flags&flagEncrypted != 0
+}
+
+func (e *entry) verify() error {
+	if e.checksum != sha1.Sum([]byte(e.value)) {
+		return fmt.Errorf("data checksum mismatch for key '%s'", e.key)
+	}
+	return nil
+}
+
+// 0           4            8     kl+8  kl+12     kl+vl+12   <-- offset
+// (full size) (flags, kl)  (key) (vl)  (value)   (checksum)
+// 4           1, 3         ....  4     .....     20         <-- length
+
+// recordOverhead is the size of a record without its key and value.
+const recordOverhead = 12 + sha1.Size
+
+func (e *entry) encodedSize() int {
+	return len(e.key) + len(e.value) + recordOverhead
+}
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
-	size := kl + vl + 12 + len(e.checksum)
+	size := e.encodedSize()
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	binary.LittleEndian.PutUint32(res[4:], uint32(e.flags)<<flagsShift|uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
@@ -32,7 +90,9 @@ func (e *entry) Encode() []byte {
 }
 
 func (e *entry) Decode(input []byte) {
-	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	klField := binary.LittleEndian.Uint32(input[4:])
+	kl := int(klField & maxKeyLen)
+	e.flags = byte(klField >> flagsShift)
 	keyStart := 8
 	valueLen := int(binary.LittleEndian.Uint32(input[keyStart+kl:]))
 
@@ -58,10 +118,45 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
 	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
 	e.Decode(buf)
 	return n, nil
 }
+
+// decodeKeyFromReader reads a record like DecodeFromReader but keeps only its
+// key and flags. The value is skipped, so large values are never loaded.
+func (e *entry) decodeKeyFromReader(in *bufio.Reader) (int, error) {
+	header, err := in.Peek(8)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("decodeKeyFromReader, cannot read header: %w", err)
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	klField := binary.LittleEndian.Uint32(header[4:])
+	kl := int(klField & maxKeyLen)
+	if size < 8+kl {
+		return 0, fmt.Errorf("decodeKeyFromReader, bad record size %d", size)
+	}
+
+	buf := make([]byte, 8+kl)
+	n, err := io.ReadFull(in, buf)
+	if err == nil {
+		var skipped int
+		skipped, err = in.Discard(size - n)
+		n += skipped
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return n, fmt.Errorf("decodeKeyFromReader, cannot read record: %w", err)
+	}
+	e.flags = byte(klField >> flagsShift)
+	e.key = string(buf[8:])
+	return n, nil
+}
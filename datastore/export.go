@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// ExportRecord is one line of the JSON Lines format of Export and Import.
+type ExportRecord struct {
+	// Bucket is empty for keys of the default bucket.
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	// TTL is the remaining lifetime of the key in seconds. Db keys never
+	// expire, so Export leaves it out; Import skips records whose TTL has
+	// run out and keeps the others without one.
+	TTL *int64 `json:"ttl,omitempty"`
+	// Type tells how Value is encoded: TypeString (the default) or
+	// TypeBase64 for values that are not valid UTF-8.
+	Type string `json:"type,omitempty"`
+}
+
+const (
+	TypeString = "string"
+	TypeBase64 = "base64"
+)
+
+// importBatch is the number of imported records handed to the write loop
+// at once.
+const importBatch = 100
+
+// ErrBadRecord is wrapped by Import errors about a malformed record.
+var ErrBadRecord = errors.New("malformed record")
+
+// Export writes every live key to w as JSON Lines. Named buckets come first,
+// in the order of their names, then the default bucket; keys are sorted
+// within each bucket.
+func (db *Db) Export(w io.Writer) error {
+	return db.ExportContext(context.Background(), w)
+}
+
+func (db *Db) ExportContext(ctx context.Context, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, key := range db.keys() {
+		value, err := db.get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		record := ExportRecord{Value: value}
+		record.Bucket, record.Key = splitBucketKey(key)
+		if !utf8.ValidString(value) {
+			record.Type = TypeBase64
+			record.Value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import stores the records read from r in the Export format and returns
+// how many of them it stored. Records are written in batches as they are
+// read; the ones before a malformed record stay stored.
+func (db *Db) Import(r io.Reader) (int, error) {
+	return db.ImportContext(context.Background(), r)
+}
+
+func (db *Db) ImportContext(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	var (
+		imported int
+		batch    []entry
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.write(ctx, batch...); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		var record ExportRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var e *entry
+		if malformed(err) {
+			err = fmt.Errorf("%w: %w", ErrBadRecord, err)
+		} else if err == nil {
+			if e, err = db.importEntry(record); err != nil {
+				err = fmt.Errorf("%w: %w", ErrBadRecord, err)
+			}
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return imported, flushErr
+			}
+			return imported, fmt.Errorf("record %d: %w", line, err)
+		}
+		if e == nil {
+			continue
+		}
+		batch = append(batch, *e)
+		if len(batch) == importBatch {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+// malformed tells whether a decoding error comes from the input rather
+// than from reading it.
+func malformed(err error) bool {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// importEntry turns a record into the entry to store, or nil if the record
+// has expired.
+func (db *Db) importEntry(record ExportRecord) (*entry, error) {
+	if record.TTL != nil && *record.TTL <= 0 {
+		return nil, nil
+	}
+
+	value := record.Value
+	switch record.Type {
+	case "", TypeString:
+	case TypeBase64:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		value = string(decoded)
+	default:
+		return nil, fmt.Errorf("unknown value type %q", record.Type)
+	}
+
+	key := record.Key
+	if record.Bucket != "" {
+		if err := checkBucketName(record.Bucket); err != nil {
+			return nil, err
+		}
+		key = bucketKey(record.Bucket, key)
+	} else if err := checkDefaultKey(key); err != nil {
+		return nil, err
+	}
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	e, err := db.keyring.seal(newEntry(key, value))
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
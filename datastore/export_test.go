@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_ExportImport(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = src.Close()
+	})
+	src.Put("a", "1")
+	src.Put("deleted", "x")
+	src.Delete("deleted")
+	src.Put("binary", "\xff\x00")
+	src.Bucket("team").Put("a", "2")
+
+	var out bytes.Buffer
+	if err := src.Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"bucket":"team","key":"a","value":"2"}
+{"key":"a","value":"1"}
+{"key":"binary","value":"/wA=","type":"base64"}
+`
+	if out.String() != expected {
+		t.Errorf("Export wrote:\n%s", out.String())
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = dst.Close()
+	})
+	input := out.String() + `{"key":"expired","value":"v","ttl":0}` + "\n" + `{"key":"ttl","value":"v","ttl":60}`
+	n, err := dst.Import(strings.NewReader(input))
+	if err != nil || n != 4 {
+		t.Fatalf("Import = %d, %v", n, err)
+	}
+	for _, tc := range []struct {
+		get      func(string) (string, error)
+		key      string
+		expected string
+	}{
+		{dst.Get, "a", "1"},
+		{dst.Get, "binary", "\xff\x00"},
+		{dst.Get, "ttl", "v"},
+		{dst.Bucket("team").Get, "a", "2"},
+	} {
+		if value, err := tc.get(tc.key); err != nil || value != tc.expected {
+			t.Errorf("Get(%s) = %q, %v", tc.key, value, err)
+		}
+	}
+	if _, err := dst.Get("expired"); err != ErrNotFound {
+		t.Errorf("Expired record was imported: %v", err)
+	}
+
+	n, err = dst.Import(strings.NewReader(`{"key":"b","value":"1"}` + "\n" + `{"key":`))
+	if !errors.Is(err, ErrBadRecord) || !strings.Contains(err.Error(), "record 2") || n != 1 {
+		t.Errorf("Import of a malformed line = %d, %v", n, err)
+	}
+}
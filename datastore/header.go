@@ -0,0 +1,229 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrFormat is returned by Open for data files it cannot read.
+var ErrFormat = errors.New("unsupported data file format")
+
+// Every data file starts with a header:
+//
+//	0       4         6          7             8
+//	(magic) (version) (checksum) (compression) (created, unix nanoseconds)
+//	4       2         1          1             8
+//
+// Files written before the header existed start with a record right away.
+// They are rewritten with a header when opened.
+const (
+	headerMagic = "DSEG"
+	headerSize  = 16
+
+	formatVersion = 1
+
+	// checksumSHA1 is the only record checksum algorithm so far.
+	checksumSHA1 = 1
+	// compressionNone is the only compression so far; the field holds
+	// flags for future ones.
+	compressionNone = 0
+
+	// migratePrefix names the copies of legacy files being given a header.
+	migratePrefix = "migrate-"
+)
+
+type fileHeader struct {
+	version     uint16
+	checksum    byte
+	compression byte
+	created     time.Time
+}
+
+func newFileHeader() fileHeader {
+	return fileHeader{
+		version:     formatVersion,
+		checksum:    checksumSHA1,
+		compression: compressionNone,
+		created:     time.Now(),
+	}
+}
+
+func (h fileHeader) encode() []byte {
+	res := make([]byte, headerSize)
+	copy(res, headerMagic)
+	binary.LittleEndian.PutUint16(res[4:], h.version)
+	res[6] = h.checksum
+	res[7] = h.compression
+	binary.LittleEndian.PutUint64(res[8:], uint64(h.created.UnixNano()))
+	return res
+}
+
+func decodeFileHeader(data []byte) fileHeader {
+	return fileHeader{
+		version:     binary.LittleEndian.Uint16(data[4:]),
+		checksum:    data[6],
+		compression: data[7],
+		created:     time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:]))),
+	}
+}
+
+func (h fileHeader) validate() error {
+	switch {
+	case h.version == 0 || h.version > formatVersion:
+		return fmt.Errorf("%w: version %d, this build reads versions up to %d", ErrFormat, h.version, formatVersion)
+	case h.checksum != checksumSHA1:
+		return fmt.Errorf("%w: unknown checksum algorithm %d", ErrFormat, h.checksum)
+	case h.compression != compressionNone:
+		return fmt.Errorf("%w: unknown compression flags %#x", ErrFormat, h.compression)
+	}
+	return nil
+}
+
+// createDataFile creates an empty data file with a fresh header and opens
+// it for appending.
+func createDataFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(newFileHeader().encode()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFileHeader reads and validates the header of a data file and returns
+// the offset of its first record. If migrate is set, an empty file is given
+// a header and a legacy file without one is migrated; otherwise such files
+// are read from the start as they are.
+func readFileHeader(path string, migrate bool) (fileHeader, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHeader{}, 0, err
+	}
+	defer f.Close()
+
+	data := make([]byte, headerSize)
+	n, err := io.ReadFull(f, data)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fileHeader{}, 0, err
+	}
+	if n == 0 || !bytes.HasPrefix(data[:n], []byte(headerMagic)) {
+		if !migrate {
+			return fileHeader{}, 0, nil
+		}
+		// Only files that hold nothing but valid records are taken for
+		// legacy ones, anything else is left as it is.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fileHeader{}, 0, err
+		}
+		if err := checkLegacyRecords(f); err != nil {
+			return fileHeader{}, 0, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fileHeader{}, 0, err
+		}
+		header, err := migrateDataFile(path, f)
+		return header, headerSize, err
+	}
+	if n < headerSize {
+		return fileHeader{}, 0, fmt.Errorf("%s: %w: truncated header", filepath.Base(path), ErrFormat)
+	}
+	header := decodeFileHeader(data)
+	if err := header.validate(); err != nil {
+		return fileHeader{}, 0, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return header, headerSize, nil
+}
+
+// checkLegacyRecords reads a data file without a header to its end and
+// returns an ErrFormat error unless it is a sequence of whole records with
+// matching checksums. Values are hashed as they are read, not loaded.
+func checkLegacyRecords(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(f)
+	for offset := int64(0); offset < info.Size(); {
+		bad := func(reason string) error {
+			return fmt.Errorf("%w: no header and no valid record at offset %d: %s", ErrFormat, offset, reason)
+		}
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(in, head); err != nil {
+			return bad("truncated record")
+		}
+		size := int64(binary.LittleEndian.Uint32(head))
+		kl := int64(binary.LittleEndian.Uint32(head[4:]) & maxKeyLen)
+		if size < recordOverhead+kl || offset+size > info.Size() {
+			return bad(fmt.Sprintf("bad record size %d", size))
+		}
+		if _, err := in.Discard(int(kl)); err != nil {
+			return bad("truncated key")
+		}
+		if _, err := io.ReadFull(in, head[:4]); err != nil {
+			return bad("truncated value length")
+		}
+		if vl := int64(binary.LittleEndian.Uint32(head)); recordOverhead+kl+vl != size {
+			return bad(fmt.Sprintf("value length %d does not match record size %d", vl, size))
+		}
+		sum := sha1.New()
+		if _, err := io.CopyN(sum, in, size-recordOverhead-kl); err != nil {
+			return bad("truncated value")
+		}
+		var checksum [sha1.Size]byte
+		if _, err := io.ReadFull(in, checksum[:]); err != nil {
+			return bad("truncated checksum")
+		}
+		if !bytes.Equal(sum.Sum(nil), checksum[:]) {
+			return bad("checksum mismatch")
+		}
+		offset += size
+	}
+	return nil
+}
+
+// migrateDataFile rewrites a legacy data file with a header in front of its
+// records. The new content is written next to the file and renamed over it,
+// so a crash leaves either the old file or the new one.
+func migrateDataFile(path string, records io.Reader) (fileHeader, error) {
+	header := newFileHeader()
+	tempPath := filepath.Join(filepath.Dir(path), migratePrefix+filepath.Base(path))
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	_, err = f.Write(header.encode())
+	if err == nil {
+		_, err = io.Copy(f, records)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fileHeader{}, err
+	}
+	return header, nil
+}
+
+// skipHeader positions r at the first record of a data file.
+func skipHeader(r io.Reader) error {
+	_, err := io.CopyN(io.Discard, r, headerSize)
+	return err
+}
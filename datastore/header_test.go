@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_LegacyFilesMigrated(t *testing.T) {
+	tmp := t.TempDir()
+
+	// Files written before headers existed hold records only.
+	legacy := func(name string, records ...entry) {
+		var data []byte
+		for _, e := range records {
+			data = append(data, e.Encode()...)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy(segmentPrefix+"1", newEntry("a", "old"), newEntry("b", "b"))
+	legacy(outFileName, newEntry("a", "new"))
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for key, expected := range map[string]string{"a": "new", "b": "b"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+
+	for _, name := range []string{segmentPrefix + "1", outFileName} {
+		data, err := os.ReadFile(filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(headerMagic)) {
+			t.Errorf("%s was not given a header", name)
+		}
+	}
+
+	// Writes after the migration land behind the header and the old records.
+	db.Put("c", "c")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("c"); err != nil || value != "c" {
+		t.Errorf("Get(c) after reopening = %q, %v", value, err)
+	}
+}
+
+func TestDb_UnknownFormatVersion(t *testing.T) {
+	tmp := t.TempDir()
+	header := newFileHeader()
+	header.version = formatVersion + 1
+	if err := os.WriteFile(filepath.Join(tmp, outFileName), header.encode(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Open(tmp)
+	if !errors.Is(err, ErrFormat) || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("Open of a file from a newer version returned %v", err)
+	}
+}
+
+func TestDb_ForeignFileNotMigrated(t *testing.T) {
+	record := newEntry("a", "value")
+	valid := record.Encode()
+	corrupt := append([]byte(nil), valid...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	for name, content := range map[string][]byte{
+		"garbage":   []byte("this is not a data file at all"),
+		"truncated": valid[:len(valid)-5],
+		"corrupt":   corrupt,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			path := filepath.Join(tmp, segmentPrefix+"1")
+			if err := os.WriteFile(path, content, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(tmp)
+			if err == nil {
+				db.Close()
+			}
+			if !errors.Is(err, ErrFormat) {
+				t.Errorf("Open returned %v", err)
+			}
+			if data, _ := os.ReadFile(path); !bytes.Equal(data, content) {
+				t.Errorf("The file was changed to %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrNoIndex = errors.New("secondary index does not exist")
+
+// IndexSpec declares a secondary index over JSON values of a bucket.
+type IndexSpec struct {
+	Name string
+	// Bucket is the indexed bucket; empty means the default one.
+	Bucket string
+	// Path selects the indexed field, e.g. "team.name" or "$.members.0".
+	// Numeric parts index into arrays.
+	Path string
+}
+
+// secondaryIndex maps values found at a JSON path to the keys holding them.
+// Strings are indexed as they are, numbers and booleans by their JSON text;
+// values that are not JSON or have no scalar at the path are left out.
+type secondaryIndex struct {
+	spec    IndexSpec
+	prefix  string
+	path    []string
+	byKey   map[string]string
+	byValue map[string]map[string]struct{}
+}
+
+func newSecondaryIndex(spec IndexSpec) (*secondaryIndex, error) {
+	if spec.Name == "" {
+		return nil, errors.New("index name is empty")
+	}
+	prefix := ""
+	if spec.Bucket != "" {
+		if err := checkBucketName(spec.Bucket); err != nil {
+			return nil, err
+		}
+		prefix = bucketKey(spec.Bucket, "")
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(spec.Path, "$"), ".")
+	if path == "" {
+		return nil, fmt.Errorf("index %s: empty path", spec.Name)
+	}
+	return &secondaryIndex{
+		spec:    spec,
+		prefix:  prefix,
+		path:    strings.Split(path, "."),
+		byKey:   make(map[string]string),
+		byValue: make(map[string]map[string]struct{}),
+	}, nil
+}
+
+// covers tells whether the internal key belongs to the indexed bucket.
+func (ix *secondaryIndex) covers(key string) bool {
+	if ix.prefix == "" {
+		return !isBucketKey(key)
+	}
+	return strings.HasPrefix(key, ix.prefix)
+}
+
+// update records the new value of the key; deleted keys leave the index.
+func (ix *secondaryIndex) update(key, value string, deleted bool) {
+	if old, ok := ix.byKey[key]; ok {
+		delete(ix.byKey, key)
+		delete(ix.byValue[old], key)
+		if len(ix.byValue[old]) == 0 {
+			delete(ix.byValue, old)
+		}
+	}
+	if deleted {
+		return
+	}
+	indexed, ok := ix.extract(value)
+	if !ok {
+		return
+	}
+	ix.byKey[key] = indexed
+	keys := ix.byValue[indexed]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		ix.byValue[indexed] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (ix *secondaryIndex) extract(value string) (string, bool) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return "", false
+	}
+	for _, part := range ix.path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			doc = node[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			doc = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		text, _ := json.Marshal(v)
+		return string(text), true
+	default:
+		return "", false
+	}
+}
+
+// lookup returns the sorted keys, relative to the bucket, holding value.
+func (ix *secondaryIndex) lookup(value string) []string {
+	keys := make([]string, 0, len(ix.byValue[value]))
+	for key := range ix.byValue[value] {
+		keys = append(keys, key[len(ix.prefix):])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// buildIndexes fills the declared indexes from the data on disk.
+func (db *Db) buildIndexes(specs []IndexSpec) error {
+	db.indexes = make(map[string]*secondaryIndex)
+	for _, spec := range specs {
+		if _, dup := db.indexes[spec.Name]; dup {
+			return fmt.Errorf("index %s is declared twice", spec.Name)
+		}
+		ix, err := newSecondaryIndex(spec)
+		if err != nil {
+			return err
+		}
+		db.indexes[spec.Name] = ix
+	}
+	if len(db.indexes) == 0 {
+		return nil
+	}
+
+	for _, key := range db.keys() {
+		value, err := db.lookup(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, ix := range db.indexes {
+			if ix.covers(key) {
+				ix.update(key, value, false)
+			}
+		}
+	}
+	return nil
+}
+
+// indexed tells whether any index covers the internal key.
+func (db *Db) indexed(key string) bool {
+	for _, ix := range db.indexes {
+		if ix.covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateIndexes is called by the write loop for every stored record.
+func (db *Db) updateIndexes(e entry) error {
+	if len(db.indexes) == 0 {
+		return nil
+	}
+	plain, err := db.keyring.open(e)
+	if err != nil {
+		return err
+	}
+
+	db.idxMu.Lock()
+	defer db.idxMu.Unlock()
+	for _, ix := range db.indexes {
+		if ix.covers(plain.key) {
+			ix.update(plain.key, plain.value, plain.deleted())
+		}
+	}
+	return nil
+}
+
+// Lookup returns the keys whose value has eq at the path of the named
+// index. Keys are relative to the indexed bucket and sorted.
+func (db *Db) Lookup(name, eq string) ([]string, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	db.idxMu.RLock()
+	defer db.idxMu.RUnlock()
+	ix, ok := db.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoIndex, name)
+	}
+	return ix.lookup(eq), nil
+}
+
+// Index returns the declaration of the named index.
+func (db *Db) Index(name string) (IndexSpec, bool) {
+	db.idxMu.RLock()
+	defer db.idxMu.RUnlock()
+	ix, ok := db.indexes[name]
+	if !ok {
+		return IndexSpec{}, false
+	}
+	return ix.spec, true
+}
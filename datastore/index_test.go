@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSecondaryIndex_Extract(t *testing.T) {
+	ix, err := newSecondaryIndex(IndexSpec{Name: "i", Path: "$.team.members.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		doc      string
+		expected string
+		ok       bool
+	}{
+		{`{"team": {"members": ["a", "b"]}}`, "b", true},
+		{`{"team": {"members": ["a", 42]}}`, "42", true},
+		{`{"team": {"members": ["a", true]}}`, "true", true},
+		{`{"team": {"members": ["a", {"x": 1}]}}`, "", false},
+		{`{"team": {"members": ["a"]}}`, "", false},
+		{`{"team": "x"}`, "", false},
+		{`not json`, "", false},
+	} {
+		value, ok := ix.extract(tc.doc)
+		if value != tc.expected || ok != tc.ok {
+			t.Errorf("extract(%s) = %q, %t", tc.doc, value, ok)
+		}
+	}
+}
+
+func TestDb_SecondaryIndex(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{
+		MaxSize: 200,
+		Indexes: []IndexSpec{
+			{Name: "byTeam", Path: "team"},
+			{Name: "usersByTeam", Bucket: "users", Path: "team"},
+		},
+	}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	db.Put("p1", `{"team": "pickmeshki"}`)
+	db.Put("p2", `{"team": "pickmeshki"}`)
+	db.Put("p3", `{"team": "other"}`)
+	db.Put("p4", `plain text`)
+	db.Bucket("users").Put("u1", `{"team": "pickmeshki"}`)
+
+	lookup := func(name, eq string, expected ...string) {
+		t.Helper()
+		keys, err := db.Lookup(name, eq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			keys = nil
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Lookup(%s, %s) = %v, wanted %v", name, eq, keys, expected)
+		}
+	}
+	lookup("byTeam", "pickmeshki", "p1", "p2")
+	lookup("usersByTeam", "pickmeshki", "u1")
+
+	db.Put("p2", `{"team": "other"}`)
+	db.Delete("p3")
+	lookup("byTeam", "pickmeshki", "p1")
+	lookup("byTeam", "other", "p2")
+
+	if _, err := db.Lookup("missing", "x"); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Lookup on a missing index returned %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup("byTeam", "pickmeshki", "p1")
+	lookup("byTeam", "other", "p2")
+	lookup("usersByTeam", "pickmeshki", "u1")
+}
+
+func TestDb_IndexFailureKeepsWrite(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{
+		CacheSize: 1 << 10,
+		Keyring:   mustKeyring(t, testKeyA),
+		Indexes:   []IndexSpec{{Name: "byTeam", Path: "team"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	db.Put("b", "old")
+	if value, _ := db.Get("b"); value != "old" {
+		t.Fatalf("Get(b) = %q", value)
+	}
+
+	// The first record of the batch cannot be opened for the indexes.
+	broken := newEntry("a", "not sealed")
+	broken.flags = flagEncrypted
+	fixed, err := db.keyring.seal(newEntry("b", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := broken.Encode(), fixed.Encode()
+	if _, err := db.out.Write(append(first, second...)); err != nil {
+		t.Fatal(err)
+	}
+	positions := []recordPos{{size: int64(len(first))}, {offset: int64(len(first)), size: int64(len(second))}}
+	if err := db.written([]entry{broken, fixed}, positions, int64(len(first)+len(second))); err != nil {
+		t.Errorf("A stored batch was reported as failed: %v", err)
+	}
+
+	if value, err := db.Get("b"); err != nil || value != "new" {
+		t.Errorf("Get(b) = %q, %v; the cached value was kept", value, err)
+	}
+	if stats, _ := db.Stats(); stats.IndexFailures != 1 {
+		t.Errorf("IndexFailures = %d", stats.IndexFailures)
+	}
+}
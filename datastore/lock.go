@@ -0,0 +1,40 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file a writable Db holds an exclusive lock on, so that
+// two writers never append to the same directory.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by Open when another Db, in this process or another
+// one, is writing to the directory.
+var ErrLocked = errors.New("datastore directory is locked by another writer")
+
+type dirLock struct {
+	file *os.File
+}
+
+func lockDir(dir string) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{file: f}, nil
+}
+
+// release drops the lock. The file stays: removing it could let a waiting
+// writer lock a file that is no longer the one in the directory.
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile does nothing where flock is not available; keeping a single
+// writer per directory is then up to the caller.
+func lockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// lockDirEnv tells the test binary started by TestOpen_LockedInChild to act
+// as the second process.
+const lockDirEnv = "DATASTORE_LOCK_TEST_DIR"
+
+func TestOpen_Locked(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if second, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		if second != nil {
+			second.Close()
+		}
+		t.Fatalf("Second Open returned %v", err)
+	}
+	if reader, err := OpenReadOnly(tmp); err != nil {
+		t.Errorf("OpenReadOnly next to a writer failed: %v", err)
+	} else {
+		reader.Close()
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Errorf("Open after Close returned %v", err)
+	}
+}
+
+func TestOpen_LockedInChild(t *testing.T) {
+	if dir := os.Getenv(lockDirEnv); dir != "" {
+		db, err := Open(dir)
+		if err == nil {
+			db.Close()
+		}
+		fmt.Print(err)
+		return
+	}
+
+	tmp := t.TempDir()
+	child := func() string {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOpen_LockedInChild$")
+		cmd.Env = append(os.Environ(), lockDirEnv+"="+tmp)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Child process failed: %v", err)
+		}
+		return string(out)
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := child(); !strings.Contains(out, ErrLocked.Error()) {
+		t.Errorf("Open in a child process while locked printed %q", out)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := child(); !strings.Contains(out, "<nil>") {
+		t.Errorf("Open in a child process after Close printed %q", out)
+	}
+}
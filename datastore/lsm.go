@@ -0,0 +1,413 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	walFileName = "wal"
+
+	defaultMemtableSize        = 4 * 1024 * 1024 // 4MB
+	defaultCompactionThreshold = 4
+)
+
+// LSM is a storage engine that keeps recent writes in a sorted memtable
+// backed by a write-ahead log and flushes it into immutable sorted tables.
+// Tables are compacted into one when there are too many of them.
+type LSM struct {
+	dir        string
+	maxMemSize int64
+
+	mu      sync.RWMutex
+	wal     *os.File
+	mem     *memtable
+	tables  []*sstable // oldest first
+	nextSeq int
+	closed  bool
+}
+
+func OpenLSM(dir string) (*LSM, error) {
+	return OpenLSMWithMaxSize(dir, defaultMemtableSize)
+}
+
+// OpenLSMWithMaxSize opens the engine flushing the memtable once it holds
+// more than maxSize bytes of records.
+func OpenLSMWithMaxSize(dir string, maxSize int64) (*LSM, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMemtableSize
+	}
+	s := &LSM{
+		dir:        dir,
+		maxMemSize: maxSize,
+		mem:        newMemtable(),
+	}
+	if err := s.loadTables(); err != nil {
+		return nil, err
+	}
+	if err := s.replayWal(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.wal = f
+	return s, nil
+}
+
+func (s *LSM) loadTables() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, sstablePrefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		seq, err := strconv.Atoi(strings.TrimPrefix(name, sstablePrefix))
+		if err != nil {
+			continue
+		}
+		table, err := openSSTable(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		s.tables = append(s.tables, table)
+		s.nextSeq = seq + 1
+	}
+	return nil
+}
+
+func (s *LSM) replayWal() error {
+	f, err := os.Open(filepath.Join(s.dir, walFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	for {
+		var record entry
+		_, err := record.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mem.put(record)
+	}
+}
+
+func (s *LSM) Put(key, value string) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+func (s *LSM) PutContext(ctx context.Context, key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.write(ctx, newEntry(key, value))
+}
+
+func (s *LSM) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+func (s *LSM) DeleteContext(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.write(ctx, newTombstone(key))
+}
+
+func (s *LSM) write(ctx context.Context, e entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	if _, err := s.wal.Write(e.Encode()); err != nil {
+		return err
+	}
+	s.mem.put(e)
+
+	if s.mem.size < s.maxMemSize {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if len(s.tables) >= defaultCompactionThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *LSM) Get(key string) (string, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *LSM) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return "", ErrClosed
+	}
+
+	record, ok := s.mem.get(key)
+	for i := len(s.tables) - 1; !ok && i >= 0; i-- {
+		found, err := s.tables[i].get(key)
+		if err != nil {
+			return "", err
+		}
+		if found != nil {
+			record, ok = *found, true
+		}
+	}
+	if !ok || record.deleted() {
+		return "", ErrNotFound
+	}
+	return record.value, nil
+}
+
+// Scan calls fn for every key in [start, end) in key order. An empty end
+// means no upper bound. fn must not modify the store.
+func (s *LSM) Scan(start, end string, fn func(key, value string) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	it, err := s.iterate(start)
+	if err != nil {
+		return err
+	}
+	defer it.close()
+
+	for {
+		record, err := it.next()
+		if err != nil {
+			return err
+		}
+		if record == nil || (end != "" && record.key >= end) {
+			return nil
+		}
+		if record.deleted() {
+			continue
+		}
+		if err := fn(record.key, record.value); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *LSM) Iterate(fn func(key, value string) error) error {
+	return s.Scan("", "", fn)
+}
+
+func (s *LSM) iterate(start string) (iterator, error) {
+	runs := []iterator{s.mem.iterate(start)}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		it, err := s.tables[i].iterate(start)
+		if err != nil {
+			for _, run := range runs {
+				run.close()
+			}
+			return nil, err
+		}
+		runs = append(runs, it)
+	}
+	return newMergeIterator(runs)
+}
+
+// Size returns the number of bytes the store occupies on disk.
+func (s *LSM) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := s.wal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	for _, table := range s.tables {
+		size += table.size
+	}
+	return size, nil
+}
+
+func (s *LSM) Stats() (Stats, error) {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return Stats{}, ErrClosed
+	}
+	size, err := s.Size()
+	if err != nil {
+		return Stats{}, err
+	}
+	keys := 0
+	err = s.Iterate(func(string, string) error {
+		keys++
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Stats{
+		Keys:     keys,
+		Bytes:    size,
+		Segments: len(s.tables),
+	}, nil
+}
+
+// Flush writes the memtable into a new sorted table.
+func (s *LSM) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.flush()
+}
+
+func (s *LSM) flush() error {
+	if len(s.mem.records) == 0 {
+		return nil
+	}
+	table, err := writeSSTable(filepath.Join(s.dir, sstableName(s.nextSeq)), s.mem.iterate(""))
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.tables = append(s.tables, table)
+	s.mem = newMemtable()
+	return s.wal.Truncate(0)
+}
+
+// Compact merges all sorted tables into one. Tombstones are dropped since
+// the result holds the oldest records there are.
+func (s *LSM) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+func (s *LSM) compact() error {
+	if len(s.tables) < 2 {
+		return nil
+	}
+
+	runs := make([]iterator, 0, len(s.tables))
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		it, err := s.tables[i].iterate("")
+		if err != nil {
+			for _, run := range runs {
+				run.close()
+			}
+			return err
+		}
+		runs = append(runs, it)
+	}
+	merged, err := newMergeIterator(runs)
+	if err != nil {
+		return err
+	}
+	table, err := writeSSTable(filepath.Join(s.dir, sstableName(s.nextSeq)), &liveIterator{merged})
+	merged.close()
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+
+	// The merged table has the highest sequence number, so if removing the
+	// old ones fails half way the directory still reads the same.
+	for _, old := range s.tables {
+		if err := os.Remove(old.path); err != nil {
+			return err
+		}
+	}
+	s.tables = []*sstable{table}
+	return nil
+}
+
+func (s *LSM) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.wal.Close()
+}
+
+// memtable keeps the latest record of every key written since the last
+// flush.
+type memtable struct {
+	records map[string]entry
+	size    int64
+}
+
+func newMemtable() *memtable {
+	return &memtable{records: make(map[string]entry)}
+}
+
+func (m *memtable) put(e entry) {
+	if old, ok := m.records[e.key]; ok {
+		m.size -= int64(old.encodedSize())
+	}
+	m.records[e.key] = e
+	m.size += int64(e.encodedSize())
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	e, ok := m.records[key]
+	return e, ok
+}
+
+func (m *memtable) iterate(start string) iterator {
+	records := make([]entry, 0, len(m.records))
+	for key, e := range m.records {
+		if key >= start {
+			records = append(records, e)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+	return &sliceIterator{records: records}
+}
@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func countTables(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), sstablePrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLSM_FlushAndCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenLSMWithMaxSize(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if err := db.Put(key, fmt.Sprintf("value-%d-%d", i, round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := countTables(t, tmp); n == 0 || n >= defaultCompactionThreshold {
+		t.Errorf("Expected flushed and compacted tables, got %d files", n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenLSMWithMaxSize(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		expected := fmt.Sprintf("value-%d-2", i)
+		if val, err := db.Get(key); err != nil || val != expected {
+			t.Errorf("Get(%q) = %q, %v, wanted %q", key, val, err, expected)
+		}
+	}
+	if _, err := db.Get("key-100"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countTables(t, tmp); n != 1 {
+		t.Errorf("Expected 1 table after compaction, got %d", n)
+	}
+	if val, err := db.Get("key-042"); err != nil || val != "value-42-2" {
+		t.Errorf("Get(key-042) after compaction = %q, %v", val, err)
+	}
+}
+
+func TestLSM_Scan(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenLSMWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for _, key := range []string{"d", "a", "c", "e", "b"} {
+		if err := db.Put(key, "old-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Newer values live in the memtable and must shadow flushed ones.
+	db.Put("c", "new-c")
+
+	var got []string
+	err = db.Scan("b", "e", func(key, value string) error {
+		got = append(got, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "b=old-b c=new-c d=old-d"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("Scan returned %v, wanted %s", got, expected)
+	}
+}
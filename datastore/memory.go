@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps everything in a map and loses it on Close.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: make(map[string]string),
+	}
+}
+
+func (ms *MemoryStore) Get(key string) (string, error) {
+	return ms.GetContext(context.Background(), key)
+}
+
+func (ms *MemoryStore) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.data == nil {
+		return "", ErrClosed
+	}
+	value, ok := ms.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (ms *MemoryStore) Put(key, value string) error {
+	return ms.PutContext(context.Background(), key, value)
+}
+
+func (ms *MemoryStore) PutContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.data == nil {
+		return ErrClosed
+	}
+	ms.data[key] = value
+	return nil
+}
+
+func (ms *MemoryStore) Delete(key string) error {
+	return ms.DeleteContext(context.Background(), key)
+}
+
+func (ms *MemoryStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.data == nil {
+		return ErrClosed
+	}
+	delete(ms.data, key)
+	return nil
+}
+
+func (ms *MemoryStore) Iterate(fn func(key, value string) error) error {
+	ms.mu.RLock()
+	if ms.data == nil {
+		ms.mu.RUnlock()
+		return ErrClosed
+	}
+	keys := make([]string, 0, len(ms.data))
+	for key := range ms.data {
+		keys = append(keys, key)
+	}
+	ms.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := ms.Get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Stats() (Stats, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.data == nil {
+		return Stats{}, ErrClosed
+	}
+	stats := Stats{Keys: len(ms.data)}
+	for key, value := range ms.data {
+		stats.Bytes += int64(len(key) + len(value))
+	}
+	return stats, nil
+}
+
+// Close drops the data; the store cannot be used afterwards.
+func (ms *MemoryStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = nil
+	return nil
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histograms in Stats.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// SegmentStats describes one data file. LiveBytes counts the records that
+// still hold the current value of their key.
+type SegmentStats struct {
+	Name       string
+	LiveBytes  int64
+	TotalBytes int64
+	// Created is the creation time kept in the file header.
+	Created time.Time
+}
+
+// LatencyStats is a histogram of operation durations. Buckets[i] counts
+// operations that took at most LatencyBuckets[i]; Count includes the ones
+// slower than the last bucket.
+type LatencyStats struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []uint64
+}
+
+type latencyHistogram struct {
+	mu    sync.Mutex
+	stats LatencyStats
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stats.Buckets == nil {
+		h.stats.Buckets = make([]uint64, len(LatencyBuckets))
+	}
+	h.stats.Count++
+	h.stats.Sum += d
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			h.stats.Buckets[i]++
+		}
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := h.stats
+	res.Buckets = make([]uint64, len(LatencyBuckets))
+	copy(res.Buckets, h.stats.Buckets)
+	return res
+}
+
+// dbMetrics holds the counters of a Db that are not derived from its
+// indexes.
+type dbMetrics struct {
+	mu               sync.Mutex
+	merges           uint64
+	mergeDuration    time.Duration
+	checksumFailures uint64
+	rejectedWrites   uint64
+	indexFailures    uint64
+
+	get, put, queueWait latencyHistogram
+}
+
+func (m *dbMetrics) mergeDone(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merges++
+	m.mergeDuration += d
+}
+
+func (m *dbMetrics) checksumFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checksumFailures++
+}
+
+func (m *dbMetrics) rejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejectedWrites++
+}
+
+func (m *dbMetrics) indexFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.indexFailures++
+}
+
+func (m *dbMetrics) fill(stats *Stats) {
+	m.mu.Lock()
+	stats.Merges = m.merges
+	stats.MergeDuration = m.mergeDuration
+	stats.ChecksumFailures = m.checksumFailures
+	stats.Rejected = m.rejectedWrites
+	stats.IndexFailures = m.indexFailures
+	m.mu.Unlock()
+
+	stats.GetLatency = m.get.snapshot()
+	stats.PutLatency = m.put.snapshot()
+	stats.QueueWait = m.queueWait.snapshot()
+}
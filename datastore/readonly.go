@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+var (
+	// ErrReadOnly is returned by writes to a database opened with
+	// OpenReadOnly.
+	ErrReadOnly = errors.New("datastore is read-only")
+	// ErrStale is returned by reads of a read-only database when the writer
+	// has moved records since the last Refresh.
+	ErrStale = errors.New("data files changed since the last refresh")
+)
+
+// errMoved makes Refresh start over when files were rotated or merged
+// while it was reading them.
+var errMoved = errors.New("data files moved during refresh")
+
+// refreshAttempts bounds the retries of Refresh while the writer keeps
+// rotating or merging files under it.
+const refreshAttempts = 5
+
+// OpenReadOnly opens a database another process may be writing to. It never
+// creates, changes or removes files: legacy files are read as they are and
+// writes fail with ErrReadOnly. Call Refresh to see what the writer has
+// stored since.
+func OpenReadOnly(dir string) (*Db, error) {
+	return OpenWithOptions(dir, Options{ReadOnly: true})
+}
+
+// Refresh picks up the records, segments and merges written by another
+// process since the database was opened or last refreshed. A writable Db is
+// always up to date, so Refresh does nothing for it.
+func (db *Db) Refresh() error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if !db.readOnly {
+		return nil
+	}
+	var err error
+	for attempt := 0; attempt < refreshAttempts; attempt++ {
+		err = db.refresh()
+		// A file that vanished was rotated or merged away in between.
+		if !errors.Is(err, errMoved) && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *Db) refresh() error {
+	names, err := db.listSegments()
+	if err != nil {
+		return err
+	}
+	index, header, size, err := db.readDataFile(db.outPath)
+	if errors.Is(err, os.ErrNotExist) {
+		index = make(hashIndex)
+	} else if err != nil {
+		return err
+	}
+
+	db.rwMu.RLock()
+	known := make(map[string]*Segment, len(db.segments))
+	for _, seg := range db.segments {
+		known[seg.path] = seg
+	}
+	db.rwMu.RUnlock()
+
+	// Segments never change once written, so only new ones are read.
+	segments := make([]*Segment, len(names))
+	for i, name := range names {
+		path := filepath.Join(db.dir, name)
+		seg, ok := known[path]
+		if !ok {
+			if seg, err = db.loadSegment(path); err != nil {
+				return err
+			}
+		}
+		segments[i] = seg
+	}
+
+	// A rotation after the listing moved records of the active file into
+	// a segment that was not listed.
+	after, err := db.listSegments()
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(names, after) {
+		return errMoved
+	}
+
+	db.rwMu.Lock()
+	db.index, db.outCreated, db.outOffset = index, header.created, size
+	db.segments = segments
+	db.rwMu.Unlock()
+	db.cache.purge()
+
+	db.idxMu.Lock()
+	defer db.idxMu.Unlock()
+	return db.buildIndexes(db.indexSpecs)
+}
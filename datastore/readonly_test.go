@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+
+	reader, err := OpenReadOnly(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = reader.Close()
+	})
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("OpenReadOnly created %d files", len(files))
+	}
+
+	writer, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = writer.Close()
+	})
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if err := writer.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"k1", "k2", "k3", "k4"} {
+			if value, err := reader.Get(key); err != nil || value != "value of "+key {
+				t.Errorf("%s: Get(%s) = %q, %v", stage, key, value, err)
+			}
+		}
+	}
+	check("after writes")
+	if len(reader.segments) == 0 {
+		t.Error("Reader picked up no segments")
+	}
+
+	writer.Delete("k4")
+	writer.Put("k4", "value of k4")
+	if err := writer.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	check("after a merge")
+
+	if err := reader.Put("k", "v"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put returned %v", err)
+	}
+	if err := reader.Delete("k1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete returned %v", err)
+	}
+	if err := reader.MergeSegments(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("MergeSegments returned %v", err)
+	}
+}
+
+func TestOpenReadOnly_LegacyFile(t *testing.T) {
+	tmp := t.TempDir()
+	e := newEntry("k", "v")
+	legacy := e.Encode()
+	path := filepath.Join(tmp, outFileName)
+	if err := os.WriteFile(path, legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenReadOnly(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if value, err := db.Get("k"); err != nil || value != "v" {
+		t.Errorf("Get(k) = %q, %v", value, err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, legacy) {
+		t.Error("OpenReadOnly migrated a legacy file")
+	}
+}
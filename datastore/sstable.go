@@ -0,0 +1,329 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	sstablePrefix       = "sstable-"
+	sparseIndexInterval = 16
+	sstableFooterSize   = 8
+)
+
+// sstable is an immutable file of records sorted by key.
+//
+// (records) (sparse index) (index offset)
+// ......... .............. 8
+//
+// The sparse index holds every sparseIndexInterval-th record and the last
+// one, each encoded as an entry with the record offset as its value.
+type sstable struct {
+	path    string
+	index   []indexEntry
+	dataEnd int64
+	size    int64
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+func sstableName(seq int) string {
+	return fmt.Sprintf("%s%020d", sstablePrefix, seq)
+}
+
+// writeSSTable stores the records produced by it, which must be sorted by
+// key, into a new table at path.
+func writeSSTable(path string, it iterator) (*sstable, error) {
+	tempPath := path + ".tmp"
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	table, err := writeSSTableTo(f, it)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return nil, err
+	}
+	table.path = path
+	return table, nil
+}
+
+func writeSSTableTo(f *os.File, it iterator) (*sstable, error) {
+	out := bufio.NewWriter(f)
+	table := &sstable{}
+
+	var (
+		offset int64
+		count  int
+		last   indexEntry
+	)
+	for {
+		record, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			break
+		}
+		last = indexEntry{key: record.key, offset: offset}
+		if count%sparseIndexInterval == 0 {
+			table.index = append(table.index, last)
+		}
+		n, err := out.Write(record.Encode())
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+		count++
+	}
+	if count > 0 && table.index[len(table.index)-1] != last {
+		table.index = append(table.index, last)
+	}
+
+	table.dataEnd = offset
+	for _, ie := range table.index {
+		var pos [8]byte
+		binary.LittleEndian.PutUint64(pos[:], uint64(ie.offset))
+		e := newEntry(ie.key, string(pos[:]))
+		n, err := out.Write(e.Encode())
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+	}
+
+	var footer [sstableFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[:], uint64(table.dataEnd))
+	if _, err := out.Write(footer[:]); err != nil {
+		return nil, err
+	}
+	table.size = offset + sstableFooterSize
+	return table, out.Flush()
+}
+
+func openSSTable(path string) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, fmt.Errorf("sstable %s is truncated", path)
+	}
+
+	var footer [sstableFooterSize]byte
+	if _, err := f.ReadAt(footer[:], info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	table := &sstable{
+		path:    path,
+		dataEnd: int64(binary.LittleEndian.Uint64(footer[:])),
+		size:    info.Size(),
+	}
+	if table.dataEnd > info.Size()-sstableFooterSize {
+		return nil, fmt.Errorf("sstable %s has a bad index offset", path)
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(f, table.dataEnd, info.Size()-sstableFooterSize-table.dataEnd))
+	for {
+		var record entry
+		_, err := record.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := record.verify(); err != nil {
+			return nil, err
+		}
+		table.index = append(table.index, indexEntry{
+			key:    record.key,
+			offset: int64(binary.LittleEndian.Uint64([]byte(record.value))),
+		})
+	}
+	return table, nil
+}
+
+// seekOffset returns the offset of the last indexed record with a key not
+// greater than key.
+func (t *sstable) seekOffset(key string) int64 {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key })
+	if i == 0 {
+		return 0
+	}
+	return t.index[i-1].offset
+}
+
+func (t *sstable) get(key string) (*entry, error) {
+	if len(t.index) == 0 || key < t.index[0].key || key > t.index[len(t.index)-1].key {
+		return nil, nil
+	}
+	it, err := t.iterate(key)
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+
+	for {
+		record, err := it.next()
+		if err != nil || record == nil || record.key > key {
+			return nil, err
+		}
+		if record.key == key {
+			return record, nil
+		}
+	}
+}
+
+// iterate returns the records with keys starting from start.
+func (t *sstable) iterate(start string) (iterator, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	offset := t.seekOffset(start)
+	return &tableIterator{
+		file:  f,
+		in:    bufio.NewReader(io.NewSectionReader(f, offset, t.dataEnd-offset)),
+		start: start,
+	}, nil
+}
+
+type tableIterator struct {
+	file  *os.File
+	in    *bufio.Reader
+	start string
+}
+
+func (it *tableIterator) next() (*entry, error) {
+	for {
+		var record entry
+		_, err := record.DecodeFromReader(it.in)
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.key < it.start {
+			continue
+		}
+		if err := record.verify(); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+}
+
+func (it *tableIterator) close() {
+	it.file.Close()
+}
+
+// iterator produces records in key order; next returns nil at the end.
+type iterator interface {
+	next() (*entry, error)
+	close()
+}
+
+type sliceIterator struct {
+	records []entry
+}
+
+func (it *sliceIterator) next() (*entry, error) {
+	if len(it.records) == 0 {
+		return nil, nil
+	}
+	record := &it.records[0]
+	it.records = it.records[1:]
+	return record, nil
+}
+
+func (it *sliceIterator) close() {}
+
+// liveIterator skips tombstones.
+type liveIterator struct {
+	iterator
+}
+
+func (it *liveIterator) next() (*entry, error) {
+	for {
+		record, err := it.iterator.next()
+		if err != nil || record == nil || !record.deleted() {
+			return record, err
+		}
+	}
+}
+
+// mergeIterator merges sorted runs given newest first. When several runs
+// hold the same key, the record from the newest one wins.
+type mergeIterator struct {
+	runs  []iterator
+	heads []*entry
+}
+
+func newMergeIterator(runs []iterator) (*mergeIterator, error) {
+	m := &mergeIterator{runs: runs, heads: make([]*entry, len(runs))}
+	for i, run := range runs {
+		head, err := run.next()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.heads[i] = head
+	}
+	return m, nil
+}
+
+func (m *mergeIterator) next() (*entry, error) {
+	least := -1
+	for i, head := range m.heads {
+		if head != nil && (least < 0 || head.key < m.heads[least].key) {
+			least = i
+		}
+	}
+	if least < 0 {
+		return nil, nil
+	}
+
+	record := m.heads[least]
+	for i, head := range m.heads {
+		if head == nil || head.key != record.key {
+			continue
+		}
+		next, err := m.runs[i].next()
+		if err != nil {
+			return nil, err
+		}
+		m.heads[i] = next
+	}
+	return record, nil
+}
+
+func (m *mergeIterator) close() {
+	for _, run := range m.runs {
+		run.close()
+	}
+}
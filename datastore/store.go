@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Store is implemented by every storage engine of the package.
+//
+// The Context variants give up once the context is done. After Close every
+// method returns ErrClosed.
+type Store interface {
+	Get(key string) (string, error)
+	GetContext(ctx context.Context, key string) (string, error)
+	Put(key, value string) error
+	PutContext(ctx context.Context, key, value string) error
+	// Delete removes the key. Deleting a missing key is not an error.
+	Delete(key string) error
+	DeleteContext(ctx context.Context, key string) error
+	// Iterate calls fn for every key in ascending key order and stops at
+	// the first error returned by fn.
+	Iterate(fn func(key, value string) error) error
+	Stats() (Stats, error)
+	Close() error
+}
+
+// Stats is a snapshot of store counters. Backends fill what they track.
+type Stats struct {
+	Keys     int
+	Bytes    int64
+	Segments int
+	// Files lists the data files with the active one last.
+	Files []SegmentStats
+
+	// QueueDepth is the number of writes waiting for the write loop and
+	// QueueCapacity the number that fits in its queue.
+	QueueDepth    int
+	QueueCapacity int
+	// QueueWait is the time writes spent in the queue.
+	QueueWait LatencyStats
+	// Rejected counts writes refused with ErrBusy.
+	Rejected uint64
+
+	Merges           uint64
+	MergeDuration    time.Duration
+	ChecksumFailures uint64
+	// IndexFailures counts stored records the secondary indexes could not
+	// take.
+	IndexFailures uint64
+
+	GetLatency LatencyStats
+	PutLatency LatencyStats
+
+	Cache CacheStats
+}
+
+var (
+	_ Store = (*Db)(nil)
+	_ Store = (*LSM)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+func checkKey(key string) error {
+	if len(key) > maxKeyLen {
+		return fmt.Errorf("key is longer than %d bytes", maxKeyLen)
+	}
+	return nil
+}
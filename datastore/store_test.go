@@ -0,0 +1,56 @@
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/datastore/storetest"
+)
+
+func TestDb(t *testing.T) {
+	storetest.Suite{
+		Open: func(dir string) (datastore.Store, error) {
+			return datastore.Open(dir)
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+func TestDb_SmallSegments(t *testing.T) {
+	storetest.Suite{
+		Open: func(dir string) (datastore.Store, error) {
+			return datastore.OpenWithOptions(dir, datastore.Options{MaxSize: 10, CacheSize: 1024})
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+func TestDb_Encrypted(t *testing.T) {
+	keyring, err := datastore.ParseKeyring("k1:000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.Suite{
+		Open: func(dir string) (datastore.Store, error) {
+			return datastore.OpenWithOptions(dir, datastore.Options{Keyring: keyring})
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+func TestLSM(t *testing.T) {
+	storetest.Suite{
+		Open: func(dir string) (datastore.Store, error) {
+			return datastore.OpenLSM(dir)
+		},
+		Persistent: true,
+	}.Run(t)
+}
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Suite{
+		Open: func(string) (datastore.Store, error) {
+			return datastore.NewMemoryStore(), nil
+		},
+	}.Run(t)
+}
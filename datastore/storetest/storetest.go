@@ -0,0 +1,208 @@
+// Package storetest holds the conformance tests every datastore.Store
+// implementation must pass.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// Suite describes a backend under test.
+type Suite struct {
+	// Open creates a store keeping its files in dir.
+	Open func(dir string) (datastore.Store, error)
+	// Persistent backends must keep data across Close and Open and grow on
+	// disk with every write.
+	Persistent bool
+}
+
+// Run executes the conformance tests against the backend.
+func (s Suite) Run(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := s.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	pairs := [][]string{
+		{"k1", "v1"},
+		{"k2", "v2"},
+		{"k3", "v3"},
+		{"k2", "v2.1"},
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for _, pair := range pairs {
+			err := db.Put(pair[0], pair[1])
+			if err != nil {
+				t.Errorf("Cannot put %s: %s", pair[0], err)
+			}
+			value, err := db.Get(pair[0])
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", pair[0], err)
+			}
+			if value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
+			}
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, err := db.Get("missing"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Get(missing) returned %v, wanted ErrNotFound", err)
+		}
+	})
+
+	t.Run("file growth", func(t *testing.T) {
+		if !s.Persistent {
+			t.Skip("backend does not keep data on disk")
+		}
+		statsBefore, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range pairs {
+			err := db.Put(pair[0], pair[1])
+			if err != nil {
+				t.Errorf("Cannot put %s: %s", pair[0], err)
+			}
+		}
+		statsAfter, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statsAfter.Bytes <= statsBefore.Bytes {
+			t.Errorf("Size does not grow after put (before %d, after %d)", statsBefore.Bytes, statsAfter.Bytes)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := db.Put("k4", "v4"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("k4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("k4"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Get after Delete returned %v, wanted ErrNotFound", err)
+		}
+		if err := db.Delete("never-existed"); err != nil {
+			t.Errorf("Deleting a missing key failed: %s", err)
+		}
+	})
+
+	t.Run("iterate", func(t *testing.T) {
+		var got []string
+		err := db.Iterate(func(key, value string) error {
+			got = append(got, key+"="+value)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "k1=v1 k2=v2.1 k3=v3"
+		if strings.Join(got, " ") != expected {
+			t.Errorf("Iterate visited %v, wanted %s", got, expected)
+		}
+
+		stop := errors.New("stop")
+		visited := 0
+		err = db.Iterate(func(string, string) error {
+			visited++
+			return stop
+		})
+		if err != stop || visited != 1 {
+			t.Errorf("Iterate did not stop on error: visited %d, returned %v", visited, err)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Keys != 3 {
+			t.Errorf("Stats reports %d keys, wanted 3", stats.Keys)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.PutContext(ctx, "k1", "cancelled"); !errors.Is(err, context.Canceled) {
+			t.Errorf("PutContext returned %v, wanted context.Canceled", err)
+		}
+		if _, err := db.GetContext(ctx, "k1"); !errors.Is(err, context.Canceled) {
+			t.Errorf("GetContext returned %v, wanted context.Canceled", err)
+		}
+		if value, err := db.GetContext(context.Background(), "k1"); err != nil || value != "v1" {
+			t.Errorf("Cancelled put changed the value: %q, %v", value, err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if !s.Persistent {
+			t.Skip("backend does not keep data on disk")
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = s.Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uniquePairs := make(map[string]string)
+		for _, pair := range pairs {
+			uniquePairs[pair[0]] = pair[1]
+		}
+
+		for key, expectedValue := range uniquePairs {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", key, err)
+			}
+			if value != expectedValue {
+				t.Errorf("Get(%q) = %q, wanted %q", key, value, expectedValue)
+			}
+		}
+		if _, err := db.Get("k4"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Deleted key is back after reopening: %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		closed, err := s.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := closed.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := closed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := closed.Put("k", "v"); !errors.Is(err, datastore.ErrClosed) {
+			t.Errorf("Put after Close returned %v, wanted ErrClosed", err)
+		}
+		if _, err := closed.Get("k"); !errors.Is(err, datastore.ErrClosed) {
+			t.Errorf("Get after Close returned %v, wanted ErrClosed", err)
+		}
+		if err := closed.Delete("k"); !errors.Is(err, datastore.ErrClosed) {
+			t.Errorf("Delete after Close returned %v, wanted ErrClosed", err)
+		}
+		if _, err := closed.Stats(); !errors.Is(err, datastore.ErrClosed) {
+			t.Errorf("Stats after Close returned %v, wanted ErrClosed", err)
+		}
+		if err := closed.Close(); err != nil {
+			t.Errorf("Second Close failed: %s", err)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// spoolPrefix names the temporary files PutStream copies values to before
+// they are queued for the write loop.
+const spoolPrefix = "stream-"
+
+// spooledValue is a value of PutStream waiting in a temporary file.
+type spooledValue struct {
+	key      string
+	file     *os.File
+	size     int64
+	checksum [sha1.Size]byte
+}
+
+// PutStream stores size bytes read from r under the key without holding
+// the value in memory. The value is first copied to a temporary file, so a
+// slow reader does not hold up other writes. Values stored in encrypted
+// databases are sealed as a whole and do go through memory.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	return db.PutStreamContext(context.Background(), key, r, size)
+}
+
+func (db *Db) PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.putStream(ctx, key, r, size, false)
+}
+
+// TryPutStream is PutStream that fails with ErrBusy rather than wait for room
+// in a full write queue. A queue that is full already refuses the value
+// before it is read.
+func (db *Db) TryPutStream(key string, r io.Reader, size int64) error {
+	return db.TryPutStreamContext(context.Background(), key, r, size)
+}
+
+func (db *Db) TryPutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	return db.putStream(ctx, key, r, size, true)
+}
+
+func (db *Db) putStream(ctx context.Context, key string, r io.Reader, size int64, try bool) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	// Record sizes are 32-bit.
+	if size < 0 || int64(len(key))+size+recordOverhead > math.MaxUint32 {
+		return fmt.Errorf("value of %d bytes is too large", size)
+	}
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if try && len(db.writeCh) == cap(db.writeCh) {
+		db.metrics.rejected()
+		return ErrBusy
+	}
+
+	if db.keyring != nil {
+		value := new(strings.Builder)
+		if err := copyValue(value, r, size); err != nil {
+			return err
+		}
+		return db.put(ctx, key, value.String(), try)
+	}
+
+	spool, err := os.CreateTemp(db.dir, spoolPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	sum := sha1.New()
+	if err := copyValue(io.MultiWriter(spool, sum), r, size); err != nil {
+		return err
+	}
+	value := &spooledValue{key: key, file: spool, size: size}
+	copy(value.checksum[:], sum.Sum(nil))
+	return db.submit(writeRequest{ctx: ctx, stream: value, try: try})
+}
+
+func copyValue(w io.Writer, r io.Reader, size int64) error {
+	n, err := io.CopyN(w, r, size)
+	if err == io.EOF {
+		return fmt.Errorf("value ended after %d of %d bytes: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// writeStream appends a spooled value to the active file.
+func (db *Db) writeStream(value *spooledValue) error {
+	e := entry{key: value.key, checksum: value.checksum}
+	size := int64(e.encodedSize()) + value.size
+	if err := db.makeRoom(size); err != nil {
+		return err
+	}
+
+	kl := len(e.key)
+	header := make([]byte, kl+12)
+	binary.LittleEndian.PutUint32(header, uint32(size))
+	binary.LittleEndian.PutUint32(header[4:], uint32(kl))
+	copy(header[8:], e.key)
+	binary.LittleEndian.PutUint32(header[kl+8:], uint32(value.size))
+
+	// Secondary indexes need the value itself. It is read before the record
+	// is appended, so a failure leaves nothing behind in the active file.
+	if db.indexed(e.key) {
+		if _, err := value.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		content, err := io.ReadAll(value.file)
+		if err != nil {
+			return err
+		}
+		e.value = string(content)
+	}
+
+	if _, err := value.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := db.out.Write(header)
+	if err == nil {
+		_, err = io.Copy(db.out, value.file)
+	}
+	if err == nil {
+		_, err = db.out.Write(e.checksum[:])
+	}
+	if err != nil {
+		return db.discardTail(err)
+	}
+	return db.written([]entry{e}, []recordPos{{size: size}}, size)
+}
+
+// GetStream returns a reader of the value of the key. The value is read from
+// disk as the reader is consumed and its checksum is verified at the end,
+// where a mismatch is reported instead of io.EOF. The reader must be closed.
+func (db *Db) GetStream(key string) (io.ReadCloser, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return nil, err
+	}
+	return db.getStream(key)
+}
+
+func (db *Db) getStream(key string) (io.ReadCloser, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	file, position, err := db.openRecord(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 8+len(key))
+	if _, err := file.ReadAt(header, position.offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	klField := binary.LittleEndian.Uint32(header[4:])
+	if string(header[8:]) != key || int(klField&maxKeyLen) != len(key) {
+		file.Close()
+		return nil, ErrStale
+	}
+	if byte(klField>>flagsShift)&flagEncrypted != 0 {
+		// Sealed values can only be opened as a whole.
+		value, err := db.readRecord(file, key, position)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(strings.NewReader(value)), nil
+	}
+
+	// The value length is followed by the value and its checksum.
+	valueStart := position.offset + 12 + int64(klField&maxKeyLen)
+	valueLen := position.size - (valueStart - position.offset) - sha1.Size
+	r := &valueReader{
+		db:    db,
+		key:   key,
+		file:  file,
+		value: io.NewSectionReader(file, valueStart, valueLen),
+		sum:   sha1.New(),
+	}
+	if _, err := file.ReadAt(r.checksum[:], valueStart+valueLen); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// valueReader reads a value straight from a data file.
+type valueReader struct {
+	db       *Db
+	key      string
+	file     *os.File
+	value    *io.SectionReader
+	sum      hash.Hash
+	checksum [sha1.Size]byte
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	r.sum.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.sum.Sum(nil), r.checksum[:]) {
+		r.db.metrics.checksumFailed()
+		return n, fmt.Errorf("data checksum mismatch for key '%s'", r.key)
+	}
+	return n, err
+}
+
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_PutStream(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	large := strings.Repeat("0123456789", 100)
+	db.Put("small", "v")
+	if err := db.PutStream("large", strings.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("after", "v")
+
+	// The record that does not fit into maxSize sits alone in a segment.
+	last := db.segments[len(db.segments)-1]
+	if len(last.index) != 1 || last.size != int64(headerSize+len(large)+len("large")+recordOverhead) {
+		t.Errorf("Segment of the large value holds %d keys in %d bytes", len(last.index), last.size)
+	}
+
+	readStream := func() string {
+		t.Helper()
+		r, err := db.GetStream("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if value := readStream(); value != large {
+		t.Errorf("GetStream returned %d bytes", len(value))
+	}
+	if value, err := db.Get("large"); err != nil || value != large {
+		t.Errorf("Get returned %d bytes, %v", len(value), err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSize(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := readStream(); value != large {
+		t.Errorf("GetStream after reopening returned %d bytes", len(value))
+	}
+}
+
+func TestDb_PutStreamShortReader(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	err = db.PutStream("k", strings.NewReader("short"), 10)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("PutStream of a short reader returned %v", err)
+	}
+	if _, err := db.Get("k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Incomplete value was stored: %v", err)
+	}
+	if spools, _ := filepath.Glob(filepath.Join(tmp, spoolPrefix+"*")); len(spools) != 0 {
+		t.Errorf("PutStream left %v behind", spools)
+	}
+}
+
+func TestDb_GetStreamChecksum(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.PutStream("k", strings.NewReader("value"), 5); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(db.outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("value"), []byte("VALUE"), 1)
+	if err := os.WriteFile(db.outPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.GetStream("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Reading a corrupted value returned %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrConflict is returned by Update when the keys read by a transaction
+// kept changing under it.
+var ErrConflict = errors.New("transaction conflict")
+
+// txAttempts is the number of times Update runs a transaction before it
+// gives up with ErrConflict.
+const txAttempts = 10
+
+// Tx is a transaction of Update. Reads see a consistent snapshot of the
+// keys they touch and writes stay buffered until the transaction commits.
+// A Tx must not be used outside of the function it was passed to.
+type Tx struct {
+	db  *Db
+	ctx context.Context
+
+	// reads maps every key read from the store to its version at the time.
+	reads    map[string]uint64
+	snapshot map[string]txRead
+	writes   map[string]entry
+	// order keeps the writes in the order they were made.
+	order []string
+}
+
+type txRead struct {
+	value string
+	err   error
+}
+
+// Update runs fn in a transaction and commits its writes as one atomic
+// batch. If another write changed a key fn has read before the commit, fn
+// is run again, so it must not have side effects outside of tx. An error
+// returned by fn aborts the transaction and is returned as it is.
+func (db *Db) Update(fn func(tx *Tx) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+func (db *Db) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	for attempt := 0; attempt < txAttempts; attempt++ {
+		tx := &Tx{
+			db:       db,
+			ctx:      ctx,
+			reads:    make(map[string]uint64),
+			snapshot: make(map[string]txRead),
+			writes:   make(map[string]entry),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		err := tx.commit()
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (db *Db) version(key string) uint64 {
+	db.rwMu.RLock()
+	defer db.rwMu.RUnlock()
+	return db.versions[key]
+}
+
+// Get returns the value of the key as seen by the transaction, including
+// its own writes. Repeated reads of a key return the same result.
+func (tx *Tx) Get(key string) (string, error) {
+	if err := checkDefaultKey(key); err != nil {
+		return "", err
+	}
+	if e, ok := tx.writes[key]; ok {
+		if e.deleted() {
+			return "", ErrNotFound
+		}
+		return e.value, nil
+	}
+	if read, ok := tx.snapshot[key]; ok {
+		return read.value, read.err
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return "", err
+	}
+	if tx.db.isClosed() {
+		return "", ErrClosed
+	}
+
+	// The version is taken first: a write landing before the value is read
+	// changes it, and the commit fails. The cache is bypassed since it is
+	// invalidated after the version moves.
+	version := tx.db.version(key)
+	value, err := tx.db.lookup(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	tx.reads[key] = version
+	tx.snapshot[key] = txRead{value: value, err: err}
+	return value, err
+}
+
+func (tx *Tx) Put(key, value string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	tx.set(newEntry(key, value))
+	return nil
+}
+
+func (tx *Tx) Delete(key string) error {
+	if err := checkDefaultKey(key); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	tx.set(newTombstone(key))
+	return nil
+}
+
+func (tx *Tx) set(e entry) {
+	if _, ok := tx.writes[e.key]; !ok {
+		tx.order = append(tx.order, e.key)
+	}
+	tx.writes[e.key] = e
+}
+
+// commit validates the reads and stores the writes in the write loop. A
+// read-only transaction only checks that its snapshot is still current.
+func (tx *Tx) commit() error {
+	if len(tx.writes) == 0 {
+		return tx.db.checkVersions(tx.reads)
+	}
+	records := make([]entry, len(tx.order))
+	for i, key := range tx.order {
+		e, err := tx.db.keyring.seal(tx.writes[key])
+		if err != nil {
+			return err
+		}
+		records[i] = e
+	}
+	return tx.db.submit(writeRequest{ctx: tx.ctx, records: records, batch: true, reads: tx.reads})
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Update(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithMaxSize(tmp, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	increment := func(tx *Tx) error {
+		value, err := tx.Get("counter")
+		if errors.Is(err, ErrNotFound) {
+			value = "0"
+		} else if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		return tx.Put("counter", strconv.Itoa(n+1))
+	}
+
+	const workers, increments = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				// Conflicts may exhaust the retries of a single Update.
+				err := db.Update(increment)
+				for errors.Is(err, ErrConflict) {
+					err = db.Update(increment)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := db.Get("counter"); err != nil || value != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %q, %v, wanted %d", value, err, workers*increments)
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithMaxSize(tmp, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("counter"); err != nil || value != strconv.Itoa(workers*increments) {
+		t.Errorf("counter after reopening = %q, %v", value, err)
+	}
+}
+
+func TestDb_UpdateConflict(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	attempts := 0
+	err = db.Update(func(tx *Tx) error {
+		attempts++
+		value, _ := tx.Get("k")
+		if attempts == 1 {
+			// A write outside of the transaction invalidates the read.
+			if err := db.Put("k", "outside"); err != nil {
+				return err
+			}
+		}
+		if again, _ := tx.Get("k"); again != value {
+			t.Errorf("Repeated read returned %q after %q", again, value)
+		}
+		return tx.Put("k", value+"+tx")
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("Update = %v after %d attempts", err, attempts)
+	}
+	if value, _ := db.Get("k"); value != "outside+tx" {
+		t.Errorf("k = %q", value)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Get("k")
+		db.Put("k", "again")
+		return tx.Put("other", "v")
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Update that always conflicts returned %v", err)
+	}
+	if _, err := db.Get("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Write of a failed transaction is visible: %v", err)
+	}
+
+	abort := errors.New("abort")
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put("other", "v")
+		return abort
+	}); err != abort {
+		t.Errorf("Aborted Update returned %v", err)
+	}
+	if _, err := db.Get("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Write of an aborted transaction is visible: %v", err)
+	}
+}
+
+func TestDb_TornBatch(t *testing.T) {
+	tmp := t.TempDir()
+
+	// A crash in the middle of a batch leaves its records without a commit
+	// marker; later writes follow them.
+	var data []byte
+	for _, e := range []entry{newEntry("a", "1"), newEntry("b", "2")} {
+		e.flags |= flagBatch
+		data = append(data, e.Encode()...)
+	}
+	e := newEntry("c", "3")
+	data = append(data, e.Encode()...)
+	if err := os.WriteFile(filepath.Join(tmp, outFileName), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for _, key := range []string{"a", "b"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Record %s of a torn batch was recovered: %v", key, err)
+		}
+	}
+	if value, err := db.Get("c"); err != nil || value != "3" {
+		t.Errorf("c = %q, %v", value, err)
+	}
+}
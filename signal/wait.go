@@ -8,8 +8,16 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// NotifyHangup returns a channel that receives every SIGHUP sent to the
+// process, the usual request to reload configuration.
+func NotifyHangup() <-chan os.Signal {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	return hupChannel
+}